@@ -0,0 +1,61 @@
+package gphotos
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+// Account is a labeled Google Photos account, useful when backing up
+// several users' photos from one process.
+type Account struct {
+	Label       string       // Label identifies the account and is used as its S3 prefix
+	Credentials *Credentials // Credentials for the account. Each account caches its own access token
+}
+
+// S3Options returns a copy of opts with PhotosPrefix and PhotosJSONKey
+// placed under the account's label, so accounts sharing a bucket don't
+// overwrite each other.
+func (a Account) S3Options(opts S3Options) S3Options {
+	opts.PhotosPrefix = path.Join(a.Label, opts.PhotosPrefix)
+	opts.PhotosJSONKey = path.Join(a.Label, opts.PhotosJSONKey)
+	return opts
+}
+
+// MultiAccount is a set of accounts that are picked and uploaded together.
+type MultiAccount []Account
+
+// Validate checks that every account has a label and that no two labels
+// give the same S3 prefix, since those accounts would share their photos
+// and photos json.
+func (m MultiAccount) Validate() error {
+	seen := map[string]bool{}
+	for i, a := range m {
+		prefix := joinKey(path.Clean(a.Label))
+		if prefix == "" || prefix == "." {
+			return fmt.Errorf("account %d has no label", i)
+		}
+		if seen[prefix] {
+			return fmt.Errorf("more than one account has the label %q", a.Label)
+		}
+		seen[prefix] = true
+	}
+	return nil
+}
+
+// Each calls fn for every account with S3Options scoped to that account.
+// A failure for one account doesn't stop the others; all errors are
+// returned joined together, each prefixed with the account label. Nothing
+// is called if Validate fails.
+func (m MultiAccount) Each(opts S3Options, fn func(a Account, opts S3Options) error) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	var errs []error
+	for _, a := range m {
+		if err := fn(a, a.S3Options(opts)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", a.Label, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,32 @@
+package gphotos
+
+import "testing"
+
+func TestMultiAccountRejectsSharedPrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		accounts MultiAccount
+		ok       bool
+	}{
+		{"distinct", MultiAccount{{Label: "alice"}, {Label: "bob"}}, true},
+		{"empty", MultiAccount{{Label: "alice"}, {Label: ""}}, false},
+		{"slash only", MultiAccount{{Label: "/"}}, false},
+		{"duplicate", MultiAccount{{Label: "alice"}, {Label: "alice"}}, false},
+		{"same prefix", MultiAccount{{Label: "alice"}, {Label: "alice/"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := 0
+			err := tt.accounts.Each(NewS3Options("bucket"), func(a Account, opts S3Options) error {
+				called++
+				return nil
+			})
+			if tt.ok && (err != nil || called != len(tt.accounts)) {
+				t.Errorf("got error %v after %d calls, want every account called", err, called)
+			}
+			if !tt.ok && (err == nil || called != 0) {
+				t.Errorf("got error %v after %d calls, want an error before any call", err, called)
+			}
+		})
+	}
+}
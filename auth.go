@@ -2,29 +2,113 @@ package gphotos
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/time/rate"
 )
 
+// Version is the version of this library, sent in the default User-Agent
+var Version = "0.1.0"
+
 const (
-	tokenUrl = "https://oauth2.googleapis.com/token"
+	tokenUrl      = "https://oauth2.googleapis.com/token"
+	revokeURL     = "https://oauth2.googleapis.com/revoke"
+	pickerBaseURL = "https://photospicker.googleapis.com/v1"
 )
 
+// PickerScope is the OAuth scope the Picker API needs, see Token.HasScope
+const PickerScope = "https://www.googleapis.com/auth/photospicker.mediaitems.readonly"
+
 // Credentials represents a Google Photos OAuth2 credential
 // that can be used to get a valid access token.
+//
+// Credentials are safe for concurrent use, but must not be copied after
+// first use. Always pass them around as a *Credentials.
 type Credentials struct {
-	ClientID     string // ClientID is your app's client ID from Google
-	ClientSecret string // ClientSecret is your app's client secret from Google
-	RefreshToken string // Refresh token is the _user's_ refresh token from first authentication that can be used to get a new access token
-	AccessToken  *Token // Optionally supply a valid access token, which will be used if provided
+	ClientID         string // ClientID is your app's client ID from Google
+	ClientSecret     string // ClientSecret is your app's client secret from Google
+	RefreshToken     string // Refresh token is the _user's_ refresh token from first authentication that can be used to get a new access token
+	AccessToken      *Token // Optionally supply a valid access token, which will be used if provided
+	RefreshTokenFile string // Optionally read the refresh token from this file when RefreshToken is empty. It must not be accessible by group or others
+
+	// HTTPClient is used for all requests made with these credentials,
+	// including picker sessions and media downloads started from them.
+	// Defaults to a client with no timeout when nil.
+	HTTPClient *http.Client
+
+	// TokenURL is the OAuth2 token endpoint, defaults to Google's. Override
+	// it to use a proxy or a test server.
+	TokenURL string
+	// RevokeURL is the OAuth2 revocation endpoint used by Revoke, defaults
+	// to Google's.
+	RevokeURL string
+	// PickerBaseURL is the base URL of the Picker API, defaults to
+	// `https://photospicker.googleapis.com/v1`.
+	PickerBaseURL string
+
+	// Retry is the retry policy for requests to Google that fail with a
+	// transient error. See RetryPolicy for the defaults.
+	Retry RetryPolicy
+
+	// TokenStore persists the access token across process restarts. A
+	// stored token that hasn't expired and was minted for the same client
+	// and refresh token is used instead of refreshing, and each refreshed
+	// token is saved. Defaults to keeping it in memory only.
+	TokenStore TokenStore
+
+	// Logger receives debug logs of requests, retries and polling, and info
+	// logs of uploads. Defaults to no logging when nil.
+	Logger *slog.Logger
+
+	// UserAgent is sent with every request, defaults to
+	// `polastre-gphotos/<Version>`.
+	UserAgent string
+	// Headers are added to every request, such as for a proxy. They can't
+	// replace the Authorization or Content-Type headers.
+	Headers http.Header
+
+	// Observer is notified before and after every HTTP request, including
+	// each retry, such as to count calls and measure latency per endpoint.
+	// Defaults to none when nil.
+	Observer RequestObserver
+
+	mu sync.Mutex // guards AccessToken so only one refresh happens at a time
+
+	limitersMu sync.Mutex
+	limiters   [2]*rate.Limiter // rate limiters by limitPurpose, see wait
 }
 
+// limitPurpose picks which of the credentials' rate limiters a request
+// waits on
+type limitPurpose int
+
+const (
+	limitDownloads limitPurpose = iota // media downloads, see DownloadOptions.RateLimit
+	limitAPI                           // picker API listing requests, see PollOptions.RateLimit
+)
+
 // Token is a Google OAuth2 Access Token
 type Token struct {
 	AccessToken string `json:"access_token"`
@@ -32,28 +116,101 @@ type Token struct {
 	ExpiresAt   time.Time
 	Scope       string `json:"scope"`
 	TokenType   string `json:"token_type"`
+
+	// Fingerprint identifies the client and refresh token the token was
+	// minted for, so a TokenStore shared by other credentials doesn't hand
+	// out another account's token. Not returned by Google
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// TokenExpiryLeeway is how long before its expiry time a token is treated
+// as expired, so that it isn't used for a request that outlives it.
+var TokenExpiryLeeway = 30 * time.Second
+
+// Expired reports whether the token has expired or will within
+// TokenExpiryLeeway. A nil token is expired.
+func (t *Token) Expired() bool {
+	if t == nil {
+		return true
+	}
+	return time.Now().Add(TokenExpiryLeeway).After(t.ExpiresAt)
+}
+
+// Scopes returns the scopes granted to the token. Users can deselect
+// scopes when they authorize the app, so they may not be all the scopes
+// that were requested.
+func (t *Token) Scopes() []string {
+	return strings.Fields(t.Scope)
+}
+
+// HasScope reports whether the scope was granted to the token, such as
+// PickerScope.
+func (t *Token) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes(), scope)
+}
+
+// TokenValid reports whether the credentials hold an access token that
+// isn't expired, see Token.Expired. Use it to refresh ahead of a long job.
+func (c *Credentials) TokenValid() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.AccessToken.Expired()
 }
 
 // Token fetches an access token for the provided credentials.
 // Also sets the AccessToken field of the provided credentials.
 func (c *Credentials) Token() (*Token, error) {
+	return c.TokenContext(context.Background())
+}
+
+// TokenContext is like Token, but the token refresh request is bound to ctx.
+func (c *Credentials) TokenContext(ctx context.Context) (*Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	// check if a token is already provided and not expired
+	if c.AccessToken == nil && c.TokenStore != nil {
+		// a failing store only costs a refresh, and a token minted for
+		// another client or refresh token is ignored
+		if token, err := c.TokenStore.Load(); err == nil && token != nil && token.Fingerprint == c.fingerprint() {
+			c.AccessToken = token
+		}
+	}
 	if c.AccessToken != nil {
+		// a token minted elsewhere with no expiry can't be refreshed without
+		// a refresh token, so use it as-is until Google rejects it
+		if c.AccessToken.ExpiresAt.IsZero() && c.AccessToken.AccessToken != "" &&
+			c.RefreshToken == "" && c.RefreshTokenFile == "" {
+			return c.AccessToken, nil
+		}
 		// token is expired, nil it out
-		if c.AccessToken.ExpiresAt.Before(time.Now()) {
+		if c.AccessToken.Expired() {
 			c.AccessToken = nil
 		} else {
 			return c.AccessToken, nil
 		}
 	}
+	refreshToken, err := c.refreshToken()
+	if err != nil {
+		return nil, err
+	}
 	params := url.Values{}
 	params.Add("client_id", c.ClientID)
 	params.Add("client_secret", c.ClientSecret)
-	params.Add("refresh_token", c.RefreshToken)
+	params.Add("refresh_token", refreshToken)
 	params.Add("grant_type", "refresh_token")
 	body := params.Encode()
 
-	res, err := http.Post(tokenUrl, "application/x-www-form-urlencoded", bytes.NewBufferString(body))
+	res, err := retryWhen(ctx, c.Retry, c.logger(), tokenRetryable, func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", c.tokenURL(), bytes.NewBufferString(body))
+		if err != nil {
+			return nil, err
+		}
+		c.setHeaders(req)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, err := c.do(req)
+		logResponse(c.logger(), "POST", c.tokenURL(), res, err)
+		return res, err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -61,73 +218,523 @@ func (c *Credentials) Token() (*Token, error) {
 	defer res.Body.Close()
 	token, data, err := httpReadResponse[Token](res.Body)
 	if err != nil {
+		if data != nil && !successStatus(res.StatusCode) {
+			return nil, responseError(res, data)
+		}
 		return nil, err
 	}
 	res.Body.Close()
 	// invalid token, so there must have been an error
 	if token.AccessToken == "" || token.ExpiresIn == 0 {
 		oauthError := GoogleOAuthError{}
-		if err := json.Unmarshal(data, &oauthError); err != nil {
-			return nil, err
+		if err := json.Unmarshal(data, &oauthError); err != nil || oauthError.ErrorCode == "" {
+			if !successStatus(res.StatusCode) {
+				return nil, responseError(res, data)
+			}
+			if err != nil {
+				return nil, err
+			}
 		}
 		return nil, &oauthError
 	}
 	token.ExpiresAt = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	token.Fingerprint = c.fingerprint()
 
 	c.AccessToken = token
+	if c.TokenStore != nil {
+		// the refreshed token is usable even if it can't be saved
+		_ = c.TokenStore.Save(token)
+	}
+	return token, nil
+}
+
+// fingerprint identifies the client and refresh token, without revealing
+// the refresh token, see Token.Fingerprint
+func (c *Credentials) fingerprint() string {
+	refreshToken, _ := c.refreshToken()
+	sum := sha256.Sum256([]byte(c.ClientID + "\x00" + refreshToken))
+	return hex.EncodeToString(sum[:16])
+}
+
+// TokenStore loads and saves an access token, see Credentials.TokenStore
+type TokenStore interface {
+	// Load returns the saved token, or nil if there isn't one
+	Load() (*Token, error)
+	// Save replaces the saved token. A nil token clears it, such as after
+	// the credentials are revoked
+	Save(*Token) error
+}
+
+// FileTokenStore is a TokenStore that keeps the token as json in a file,
+// which is only readable by the current user.
+type FileTokenStore struct {
+	Path string // Required. file to keep the token in
+}
+
+func (f FileTokenStore) Load() (*Token, error) {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	token := &Token{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (f FileTokenStore) Save(token *Token) error {
+	if token == nil {
+		if err := os.Remove(f.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.Path, data, 0o600)
+}
+
+// TokenSource returns an oauth2.TokenSource backed by the credentials, so
+// they can be used with oauth2.NewClient and Google client libraries.
+func (c *Credentials) TokenSource() oauth2.TokenSource {
+	return credentialsTokenSource{c}
+}
+
+type credentialsTokenSource struct {
+	c *Credentials
+}
+
+func (ts credentialsTokenSource) Token() (*oauth2.Token, error) {
+	token, err := ts.c.Token()
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      token.ExpiresAt,
+	}, nil
+}
+
+// setHeaders sets the User-Agent and the custom headers on a request
+func (c *Credentials) setHeaders(req *http.Request) {
+	for key, values := range c.Headers {
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+	userAgent := c.UserAgent
+	if userAgent == "" {
+		userAgent = "polastre-gphotos/" + Version
+	}
+	req.Header.Set("User-Agent", userAgent)
+}
+
+// wait blocks until a request is allowed by the credentials' rate limiter
+// for the purpose, at perSecond requests per second. Every request for the
+// same purpose shares one limiter, and if callers ask for different rates
+// the latest one applies to all of them. A perSecond of 0 is no limit.
+func (c *Credentials) wait(ctx context.Context, purpose limitPurpose, perSecond float64) error {
+	if perSecond <= 0 {
+		return nil
+	}
+	c.limitersMu.Lock()
+	limiter := c.limiters[purpose]
+	if limiter == nil {
+		limiter = rate.NewLimiter(rate.Limit(perSecond), 1)
+		c.limiters[purpose] = limiter
+	} else if limiter.Limit() != rate.Limit(perSecond) {
+		limiter.SetLimit(rate.Limit(perSecond))
+	}
+	c.limitersMu.Unlock()
+	return limiter.Wait(ctx)
+}
+
+// logger returns the credentials' logger, or one that discards everything
+func (c *Credentials) logger() *slog.Logger {
+	if c.Logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+	return c.Logger
+}
+
+// RequestObserver is notified of the HTTP requests made with Credentials,
+// to wire up metrics or tracing without this library depending on them.
+// The url tells the endpoints apart: the token endpoint, the picker
+// sessions and media items, and media downloads from a base URL.
+type RequestObserver interface {
+	// Before is called before the request is sent
+	Before(method, url string)
+	// After is called once the response headers are received or the
+	// request fails. status is 0 when err is set, and elapsed doesn't
+	// include reading the body.
+	After(method, url string, status int, elapsed time.Duration, err error)
+}
+
+// do sends the request with the credentials' http client, notifying the
+// Observer if one is set.
+func (c *Credentials) do(req *http.Request) (*http.Response, error) {
+	if c.Observer == nil {
+		return c.httpClient().Do(req)
+	}
+	uri := req.URL.String()
+	c.Observer.Before(req.Method, uri)
+	start := time.Now()
+	res, err := c.httpClient().Do(req)
+	status := 0
+	if res != nil {
+		status = res.StatusCode
+	}
+	c.Observer.After(req.Method, uri, status, time.Since(start), err)
+	return res, err
+}
+
+// logResponse logs the outcome of a request at debug level
+func logResponse(log *slog.Logger, method string, uri string, response *http.Response, err error) {
+	if err != nil {
+		log.Debug("request failed", "method", method, "url", uri, "error", err)
+		return
+	}
+	log.Debug("request", "method", method, "url", uri, "status", response.StatusCode)
+}
+
+// tokenURL returns the OAuth2 token endpoint to use
+func (c *Credentials) tokenURL() string {
+	if c.TokenURL != "" {
+		return c.TokenURL
+	}
+	return tokenUrl
+}
+
+func (c *Credentials) revokeURL() string {
+	if c.RevokeURL != "" {
+		return c.RevokeURL
+	}
+	return revokeURL
+}
+
+// Revoke revokes the user's refresh token at Google, such as when they
+// disconnect the app, which also revokes the access tokens made from it.
+// The AccessToken and the token in the TokenStore are cleared once it's
+// revoked. Revoking a token that's already revoked returns an
+// `invalid_token` GoogleOAuthError.
+func (c *Credentials) Revoke(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	refreshToken, err := c.refreshToken()
+	if err != nil {
+		return err
+	}
+	body := url.Values{"token": {refreshToken}}.Encode()
+	res, err := retryWhen(ctx, c.Retry, c.logger(), tokenRetryable, func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", c.revokeURL(), strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		c.setHeaders(req)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, err := c.do(req)
+		logResponse(c.logger(), "POST", c.revokeURL(), res, err)
+		return res, err
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if !successStatus(res.StatusCode) {
+		oauthError := GoogleOAuthError{}
+		if err := json.Unmarshal(data, &oauthError); err == nil && oauthError.ErrorCode != "" {
+			return &oauthError
+		}
+		return responseError(res, data)
+	}
+	c.AccessToken = nil
+	if c.TokenStore != nil {
+		// otherwise the next TokenContext would load the revoked token
+		if err := c.TokenStore.Save(nil); err != nil {
+			return fmt.Errorf("token revoked, but it couldn't be cleared from the token store: %w", err)
+		}
+	}
+	return nil
+}
+
+// pickerURL returns the Picker API URL for the path, which starts with a slash
+func (c *Credentials) pickerURL(path string) string {
+	if c.PickerBaseURL != "" {
+		return strings.TrimSuffix(c.PickerBaseURL, "/") + path
+	}
+	return pickerBaseURL + path
+}
+
+// httpClient returns the client to make requests with
+func (c *Credentials) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return &http.Client{}
+}
+
+// refreshToken returns the refresh token, reading it from
+// RefreshTokenFile if RefreshToken isn't set.
+func (c *Credentials) refreshToken() (string, error) {
+	if c.RefreshToken != "" || c.RefreshTokenFile == "" {
+		return c.RefreshToken, nil
+	}
+	info, err := os.Stat(c.RefreshTokenFile)
+	if err != nil {
+		return "", err
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return "", fmt.Errorf("refresh token file %s has permissions %#o, it must not be accessible by group or others", c.RefreshTokenFile, perm)
+	}
+	data, err := os.ReadFile(c.RefreshTokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("refresh token file %s is empty", c.RefreshTokenFile)
+	}
 	return token, nil
 }
 
-func (c Credentials) NewUserAuthorization() {
-	config := &oauth2.Config{
+// AuthOptions configure the temporary server used by NewUserAuthorization
+type AuthOptions struct {
+	RedirectURL string // Redirect URL registered with Google, defaults to `http://localhost:8080/callback`
+	ListenAddr  string // Address for the callback server to listen on, defaults to `:8080`
+}
+
+// AuthServer is a temporary server that receives the OAuth callback after
+// the user authorizes the app. It's shut down once a token is exchanged or
+// Wait's context is done, and can be stopped early with Shutdown.
+type AuthServer struct {
+	URL string // URL for the user to authorize the app at
+
+	server  *http.Server
+	results chan authResult
+}
+
+// authResult is the outcome of the first OAuth callback
+type authResult struct {
+	token *oauth2.Token
+	err   error
+}
+
+// StartUserAuthorization starts the callback server for the user to
+// authorize the app at the returned server's URL. The callback displays
+// the user's token. Call Wait for the token, or Shutdown to stop the
+// server. Returns an error if the listen address is already in use.
+func (c *Credentials) StartUserAuthorization(opts ...AuthOptions) (*AuthServer, error) {
+	options := AuthOptions{}
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	if options.RedirectURL == "" {
+		options.RedirectURL = "http://localhost:8080/callback"
+	}
+	if options.ListenAddr == "" {
+		options.ListenAddr = ":8080"
+	}
+	redirect, err := url.Parse(options.RedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redirect url %s: %w", options.RedirectURL, err)
+	}
+	listener, err := net.Listen("tcp", options.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	return c.startAuthServer(listener, c.oauthConfig(options.RedirectURL), redirect.Path,
+		func(w http.ResponseWriter, r *http.Request, config *oauth2.Config, token *oauth2.Token) {
+			// Use the token to access Google APIs
+			userInfo, err := config.Client(r.Context(), token).Get("https://www.googleapis.com/oauth2/v3/userinfo")
+			if err != nil {
+				http.Error(w, "Failed to get user info: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer userInfo.Body.Close()
+			fmt.Fprintf(w, "User info retrieved successfully!\nStore the refresh token somewhere securely.\n\n")
+			// Print json version of token
+			tokenJson, err := json.MarshalIndent(token, "", "  ")
+			if err != nil {
+				http.Error(w, "Failed to marshal token: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write(tokenJson)
+		})
+}
+
+// startAuthServer serves the OAuth callback at callbackPath on listener,
+// exchanging the code for a token and calling respond to write the page
+// shown to the user. Only the first callback's result is used.
+func (c *Credentials) startAuthServer(listener net.Listener, config *oauth2.Config, callbackPath string, respond func(w http.ResponseWriter, r *http.Request, config *oauth2.Config, token *oauth2.Token)) (*AuthServer, error) {
+	if callbackPath == "" {
+		callbackPath = "/"
+	}
+	// random state protects the callback against cross-site request forgery
+	state, err := randomState()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	s := &AuthServer{
+		URL:     config.AuthCodeURL(state, oauth2.AccessTypeOffline),
+		results: make(chan authResult, 1),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(callbackPath, func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("state")), []byte(state)) != 1 {
+			http.Error(w, "Invalid state", http.StatusBadRequest)
+			return
+		}
+		if e := r.URL.Query().Get("error"); e != "" {
+			http.Error(w, "Authorization failed: "+e, http.StatusBadRequest)
+			s.send(authResult{err: &GoogleOAuthError{ErrorCode: e, Message: r.URL.Query().Get("error_description")}})
+			return
+		}
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			http.Error(w, "Code not found", http.StatusBadRequest)
+			return
+		}
+		token, err := config.Exchange(r.Context(), code)
+		if err != nil {
+			http.Error(w, "Failed to exchange token: "+err.Error(), http.StatusInternalServerError)
+			s.send(authResult{err: err})
+			return
+		}
+		respond(w, r, config, token)
+		s.send(authResult{token: token})
+	})
+	s.server = &http.Server{Handler: mux}
+	go func() {
+		if err := s.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			s.send(authResult{err: err})
+		}
+	}()
+	return s, nil
+}
+
+// send records the result unless one was already recorded
+func (s *AuthServer) send(r authResult) {
+	select {
+	case s.results <- r:
+	default:
+	}
+}
+
+// Wait returns the user's token once they have authorized the app, or
+// ctx's error if it's done first. The server is shut down either way.
+func (s *AuthServer) Wait(ctx context.Context) (*oauth2.Token, error) {
+	defer s.Shutdown(context.WithoutCancel(ctx))
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-s.results:
+		return r.token, r.err
+	}
+}
+
+// Shutdown stops the server and releases its listener, letting a callback
+// that's in progress finish writing its response for up to 5 seconds or
+// until ctx is done.
+func (s *AuthServer) Shutdown(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// NewUserAuthorization prints a URL for the user to authorize the app and
+// runs a local server to receive the OAuth callback, which displays the
+// user's token. It returns once the token is exchanged, shutting the
+// server down, or if the server fails, such as when the listen address is
+// already in use.
+func (c *Credentials) NewUserAuthorization(opts ...AuthOptions) error {
+	s, err := c.StartUserAuthorization(opts...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Visit the following URL to authorize the app:\n%v\n", s.URL)
+	_, err = s.Wait(context.Background())
+	return err
+}
+
+// oauthConfig returns the OAuth2 config for authorizing the app with the
+// scopes it needs
+func (c *Credentials) oauthConfig(redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
 		ClientID:     c.ClientID,
 		ClientSecret: c.ClientSecret,
-		RedirectURL:  "http://localhost:8080/callback", // Replace with your redirect URL
+		RedirectURL:  redirectURL,
 		Scopes: []string{
 			"https://www.googleapis.com/auth/userinfo.profile",
 			"https://www.googleapis.com/auth/userinfo.email",
 			"https://www.googleapis.com/auth/photoslibrary.appendonly",
 			"https://www.googleapis.com/auth/photoslibrary.readonly.appcreateddata",
 			"https://www.googleapis.com/auth/photoslibrary.edit.appcreateddata",
-			"https://www.googleapis.com/auth/photospicker.mediaitems.readonly",
+			PickerScope,
 		},
 		Endpoint: google.Endpoint,
 	}
-	url := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Visit the following URL to authorize the app:\n%v\n", url)
+}
 
-	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		code := r.URL.Query().Get("code")
-		if code == "" {
-			http.Error(w, "Code not found", http.StatusBadRequest)
-			return
+// AuthorizeLoopback runs the OAuth flow for desktop and CLI apps: it
+// listens for the callback on a free port of 127.0.0.1, prints the URL for
+// the user to authorize the app and opens it in their browser when
+// openBrowser is set, then returns the user's token once they have
+// authorized it. The OAuth client must be a desktop app client, which
+// allows loopback redirects on any port. Returns ctx's error if it's done
+// before the user finishes.
+func (c *Credentials) AuthorizeLoopback(ctx context.Context, openBrowser bool) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	config := c.oauthConfig(fmt.Sprintf("http://%s/callback", listener.Addr()))
+	s, err := c.startAuthServer(listener, config, "/callback",
+		func(w http.ResponseWriter, r *http.Request, config *oauth2.Config, token *oauth2.Token) {
+			fmt.Fprintf(w, "The app is authorized, you can close this window.\n")
+		})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Visit the following URL to authorize the app:\n%v\n", s.URL)
+	if openBrowser {
+		if err := openURL(s.URL); err != nil {
+			fmt.Printf("Unable to open a browser, visit the URL above: %v\n", err)
 		}
+	}
+	return s.Wait(ctx)
+}
 
-		token, err := config.Exchange(ctx, code)
-		if err != nil {
-			http.Error(w, "Failed to exchange token: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// Use the token to access Google APIs
-		client := config.Client(ctx, token)
-		userInfo, err := client.Get("https://www.googleapis.com/oauth2/v3/userinfo")
-		if err != nil {
-			http.Error(w, "Failed to get user info: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer userInfo.Body.Close()
-		// Process the user information
-		fmt.Fprintf(w, "User info retrieved successfully!\nStore the refresh token somewhere securely.\n\n")
-		// Print json version of token
-		tokenJson, err := json.MarshalIndent(token, "", "  ")
-		if err != nil {
-			http.Error(w, "Failed to marshal token: "+err.Error(), http.StatusInternalServerError)
-		}
-		w.Write(tokenJson)
-	})
+// openURL opens the url in the user's browser
+func openURL(u string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", u).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", u).Start()
+	default:
+		return exec.Command("xdg-open", u).Start()
+	}
+}
 
-	http.ListenAndServe(":8080", nil)
+// randomState returns a random, url safe OAuth state value
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 // GoogleOAuthError represents an error during an OAuth exchange with Google
@@ -139,3 +746,13 @@ type GoogleOAuthError struct {
 func (e GoogleOAuthError) Error() string {
 	return fmt.Sprintf("%s: %s", e.ErrorCode, e.Message)
 }
+
+// ErrRefreshTokenRevoked is matched by errors.Is when Google rejects the
+// refresh token with `invalid_grant` because it was revoked or expired.
+// The user needs to authorize the app again to get a new refresh token.
+var ErrRefreshTokenRevoked = errors.New("the refresh token has been revoked or expired")
+
+// Is makes an `invalid_grant` error match ErrRefreshTokenRevoked
+func (e GoogleOAuthError) Is(target error) bool {
+	return target == ErrRefreshTokenRevoked && e.ErrorCode == "invalid_grant"
+}
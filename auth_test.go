@@ -0,0 +1,186 @@
+package gphotos
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// memTokenStore is a TokenStore that keeps the token in memory
+type memTokenStore struct {
+	token *Token
+}
+
+func (m *memTokenStore) Load() (*Token, error) { return m.token, nil }
+
+func (m *memTokenStore) Save(token *Token) error {
+	m.token = token
+	return nil
+}
+
+// tokenServer serves the token and revoke endpoints, counting refreshes
+func tokenServer(t *testing.T, refreshes *atomic.Int32) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		refreshes.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"fresh","expires_in":3600,"token_type":"Bearer"}`))
+	})
+	mux.HandleFunc("/revoke", func(w http.ResponseWriter, r *http.Request) {})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRevokeClearsTokenStore(t *testing.T) {
+	var refreshes atomic.Int32
+	server := tokenServer(t, &refreshes)
+	store := &memTokenStore{}
+	c := &Credentials{
+		RefreshToken: "refresh",
+		TokenURL:     server.URL + "/token",
+		RevokeURL:    server.URL + "/revoke",
+		TokenStore:   store,
+	}
+	store.token = &Token{AccessToken: "stored", ExpiresAt: time.Now().Add(time.Hour), Fingerprint: c.fingerprint()}
+
+	if err := c.Revoke(context.Background()); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if store.token != nil {
+		t.Fatalf("store still holds %q after Revoke", store.token.AccessToken)
+	}
+	token, err := c.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if token.AccessToken != "fresh" || refreshes.Load() != 1 {
+		t.Errorf("got token %q after %d refreshes, want a refreshed token", token.AccessToken, refreshes.Load())
+	}
+}
+
+func TestTokenWithoutExpiry(t *testing.T) {
+	var refreshes atomic.Int32
+	server := tokenServer(t, &refreshes)
+
+	// with a refresh token, a token with no expiry is refreshed
+	c := &Credentials{
+		RefreshToken: "refresh",
+		AccessToken:  &Token{AccessToken: "stale"},
+		TokenURL:     server.URL + "/token",
+	}
+	token, err := c.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if token.AccessToken != "fresh" || refreshes.Load() != 1 {
+		t.Errorf("got token %q after %d refreshes, want a refreshed token", token.AccessToken, refreshes.Load())
+	}
+
+	// with only an access token, it's used as-is
+	c = &Credentials{
+		AccessToken: &Token{AccessToken: "minted"},
+		TokenURL:    server.URL + "/token",
+	}
+	token, err = c.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if token.AccessToken != "minted" || refreshes.Load() != 1 {
+		t.Errorf("got token %q after %d refreshes, want the minted token", token.AccessToken, refreshes.Load())
+	}
+}
+
+// TestTokenConcurrentRefresh is meant to be run with -race
+func TestTokenConcurrentRefresh(t *testing.T) {
+	var refreshes atomic.Int32
+	server := tokenServer(t, &refreshes)
+	c := &Credentials{RefreshToken: "refresh", TokenURL: server.URL + "/token"}
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 50)
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := c.Token()
+			if err != nil {
+				t.Errorf("Token: %v", err)
+				return
+			}
+			tokens[i] = token.AccessToken
+		}()
+	}
+	wg.Wait()
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("got %d refreshes, want 1", n)
+	}
+	for _, token := range tokens {
+		if token != "fresh" {
+			t.Fatalf("got token %q, want the refreshed token", token)
+		}
+	}
+}
+
+func TestAuthCallbackRejectsMismatchedState(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Credentials{ClientID: "client"}
+	config := c.oauthConfig("http://" + listener.Addr().String() + "/callback")
+	s, err := c.startAuthServer(listener, config, "/callback",
+		func(w http.ResponseWriter, r *http.Request, config *oauth2.Config, token *oauth2.Token) {
+			t.Error("the callback was accepted")
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/callback?state=wrong&code=code", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want 400", w.Code)
+	}
+	select {
+	case r := <-s.results:
+		t.Errorf("got a result %v for a forged callback", r)
+	default:
+	}
+}
+
+func TestFileTokenStoreIgnoresOtherRefreshTokens(t *testing.T) {
+	var refreshes atomic.Int32
+	server := tokenServer(t, &refreshes)
+	store := FileTokenStore{Path: t.TempDir() + "/token.json"}
+
+	first := &Credentials{RefreshToken: "first", TokenURL: server.URL + "/token", TokenStore: store}
+	if _, err := first.Token(); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	// the same refresh token reuses the cached token
+	again := &Credentials{RefreshToken: "first", TokenURL: server.URL + "/token", TokenStore: store}
+	if _, err := again.Token(); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if n := refreshes.Load(); n != 1 {
+		t.Fatalf("got %d refreshes, want the cached token reused", n)
+	}
+	// another account's refresh token doesn't
+	other := &Credentials{RefreshToken: "other", TokenURL: server.URL + "/token", TokenStore: store}
+	if _, err := other.Token(); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if n := refreshes.Load(); n != 2 {
+		t.Errorf("got %d refreshes, want the other refresh token to refresh", n)
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+
 	"github.com/alexflint/go-arg"
 	"github.com/polastre/gphotos"
 )
@@ -9,11 +13,32 @@ func main() {
 	var args struct {
 		GoogleClientID     string `arg:"env:GOOGLE_CLIENT_ID,--client-id,required"`
 		GoogleClientSecret string `arg:"env:GOOGLE_CLIENT_SECRET,--client-secret,required"`
+		RedirectURL        string `arg:"--redirect-url" help:"OAuth redirect URL registered with Google" default:"http://localhost:8080/callback"`
+		ListenAddr         string `arg:"--listen-addr" help:"Address for the callback server to listen on" default:":8080"`
+		Loopback           bool   `arg:"--loopback" help:"Listen on a free loopback port and open the browser, for desktop app OAuth clients"`
 	}
 	arg.MustParse(&args)
 	creds := gphotos.Credentials{
 		ClientID:     args.GoogleClientID,
 		ClientSecret: args.GoogleClientSecret,
 	}
-	creds.NewUserAuthorization()
+	if args.Loopback {
+		token, err := creds.AuthorizeLoopback(context.Background(), true)
+		if err != nil {
+			panic(err)
+		}
+		tokenJson, err := json.MarshalIndent(token, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(tokenJson))
+		return
+	}
+	err := creds.NewUserAuthorization(gphotos.AuthOptions{
+		RedirectURL: args.RedirectURL,
+		ListenAddr:  args.ListenAddr,
+	})
+	if err != nil {
+		panic(err)
+	}
 }
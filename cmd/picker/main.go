@@ -16,27 +16,53 @@ func main() {
 		AWSAccessKeyID     string `arg:"env:AWS_ACCESS_KEY_ID,required"`
 		AWSSecretAccessKey string `arg:"env:AWS_SECRET_ACCESS_KEY,required"`
 		AWSRegion          string `arg:"env:AWS_REGION,--region,required"`
-		Token              string `arg:"--token,-t,required" help:"Google OAuth Refresh Token"`
+		Token              string `arg:"--token,-t" help:"Google OAuth Refresh Token"`
+		TokenFile          string `arg:"--token-file" help:"File containing the Google OAuth Refresh Token"`
+		TokenCache         string `arg:"--token-cache" help:"File to cache the access token in between runs"`
 		Bucket             string `arg:"--bucket,-b,required" help:"Destination S3 Bucket"`
+		MetricsAddr        string `arg:"--metrics-addr" help:"Serve /metrics and /healthz on this address, e.g. :9090"`
+		PerSession         bool   `arg:"--per-session" help:"Upload under photos/<session id>/ with its own photos.json"`
+	}
+	p := arg.MustParse(&args)
+	if args.Token == "" && args.TokenFile == "" {
+		p.Fail("one of --token or --token-file is required")
 	}
-	arg.MustParse(&args)
 
-	// set AWS values in environment if they're provided by flags instead of env
-	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
-		os.Setenv("AWS_ACCESS_KEY_ID", args.AWSAccessKeyID)
+	m := &metrics{}
+	if args.MetricsAddr != "" {
+		if err := m.serve(args.MetricsAddr); err != nil {
+			panic(err)
+		}
 	}
-	if os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
-		os.Setenv("AWS_SECRET_ACCESS_KEY", args.AWSSecretAccessKey)
+
+	s3opts := gphotos.NewS3Options(args.Bucket)
+	s3opts.Width = 2048
+	s3opts.Region = args.AWSRegion
+	s3opts.AccessKeyID = args.AWSAccessKeyID
+	s3opts.SecretAccessKey = args.AWSSecretAccessKey
+	s3opts.PerSessionPrefix = args.PerSession
+	s3opts.OnResult = m.record
+	s3opts.OnProgress = func(item gphotos.GooglePhotosPickedItem, done, total int, err error) {
+		if err != nil {
+			fmt.Printf("[%d/%d] failed %s: %v\n", done, total, item.Media.Filename, err)
+			return
+		}
+		fmt.Printf("[%d/%d] uploaded %s\n", done, total, item.Media.Filename)
 	}
-	if os.Getenv("AWS_REGION") == "" {
-		os.Setenv("AWS_REGION", args.AWSRegion)
+	// check the bucket before the user spends time picking
+	if err := s3opts.Validate(context.Background()); err != nil {
+		panic(err)
 	}
 
 	// need refresh token and s3 bucket as input
 	creds := gphotos.Credentials{
-		ClientID:     args.GoogleClientID,
-		ClientSecret: args.GoogleClientSecret,
-		RefreshToken: args.Token,
+		ClientID:         args.GoogleClientID,
+		ClientSecret:     args.GoogleClientSecret,
+		RefreshToken:     args.Token,
+		RefreshTokenFile: args.TokenFile,
+	}
+	if args.TokenCache != "" {
+		creds.TokenStore = gphotos.FileTokenStore{Path: args.TokenCache}
 	}
 	sesh, err := creds.NewPickerSession()
 	if err != nil {
@@ -46,6 +72,7 @@ func main() {
 
 	photos, err := sesh.Poll(context.Background(),
 		func(s *gphotos.GooglePhotosPickerSession) bool {
+			m.polls.Add(1)
 			if s.MediaItemsSet {
 				fmt.Printf("photos have been picked for session: %s\n", s.ID)
 			} else {
@@ -58,14 +85,25 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	m.picked.Add(int64(len(photos)))
 	for _, p := range photos {
-		fmt.Printf("[%s] %s (%s - %s)\n", p.ID[:8], p.Media.Filename, p.Media.Metadata.CameraMake, p.Media.Metadata.CameraModel)
+		fmt.Printf("%s %s %s\n", p, p.Media.Metadata.CameraMake, p.Media.Metadata.CameraModel)
 	}
 	fmt.Printf("%d total items, now uploading to S3\n", len(photos))
 
-	s3opts := gphotos.NewS3Options(args.Bucket)
-	s3opts.Width = 2048
-	err = creds.UploadToS3(photos, s3opts)
+	s3opts.PickerSession = sesh
+	results, err := creds.UploadToS3Detailed(photos, s3opts)
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		// each failure was already printed as it happened
+		fmt.Printf("%d of %d photos failed to upload, the photos json wasn't written\n", failed, len(photos))
+		os.Exit(1)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/polastre/gphotos"
+)
+
+// metrics are the counters exposed on /metrics in the Prometheus text format
+type metrics struct {
+	polls    atomic.Int64 // number of times the picker session was polled
+	picked   atomic.Int64 // number of items picked by the user
+	uploaded atomic.Int64 // number of items uploaded to S3
+	skipped  atomic.Int64 // number of items skipped because they were already in S3 or too small
+	bytes    atomic.Int64 // number of bytes uploaded to S3
+	errors   atomic.Int64 // number of items that failed to upload
+}
+
+// serve starts serving /metrics and /healthz on addr in the background.
+// Errors binding to addr are returned immediately.
+func (m *metrics) serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.handleMetrics)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	go http.Serve(listener, mux)
+	return nil
+}
+
+// record counts the result of uploading an item
+func (m *metrics) record(result gphotos.UploadResult) {
+	switch {
+	case result.Err != nil:
+		m.errors.Add(1)
+	case result.Skipped:
+		m.skipped.Add(1)
+	default:
+		m.uploaded.Add(1)
+		m.bytes.Add(result.Bytes)
+	}
+}
+
+func (m *metrics) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	counters := []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"gphotos_picker_polls_total", "Number of times the picker session was polled.", m.polls.Load()},
+		{"gphotos_picker_items_picked_total", "Number of items picked by the user.", m.picked.Load()},
+		{"gphotos_picker_items_uploaded_total", "Number of items uploaded to S3.", m.uploaded.Load()},
+		{"gphotos_picker_items_skipped_total", "Number of items skipped because they were already in S3 or too small.", m.skipped.Load()},
+		{"gphotos_picker_bytes_uploaded_total", "Number of bytes uploaded to S3.", m.bytes.Load()},
+		{"gphotos_picker_errors_total", "Number of items that failed to upload.", m.errors.Load()},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+}
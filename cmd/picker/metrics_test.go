@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/polastre/gphotos"
+)
+
+func TestMetricsRecord(t *testing.T) {
+	m := &metrics{}
+	m.record(gphotos.UploadResult{Bytes: 100})
+	m.record(gphotos.UploadResult{Bytes: 50})
+	m.record(gphotos.UploadResult{Skipped: true})
+	m.record(gphotos.UploadResult{Err: errors.New("boom")})
+
+	w := httptest.NewRecorder()
+	m.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"gphotos_picker_items_uploaded_total 2\n",
+		"gphotos_picker_items_skipped_total 1\n",
+		"gphotos_picker_bytes_uploaded_total 150\n",
+		"gphotos_picker_errors_total 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package gphotos
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DownloadOptions configure how media is requested from Google Photos
+type DownloadOptions struct {
+	// Width and Height are the size of the image to request from Google
+	// Photos. With both set, the image is resized to fit within them,
+	// keeping its aspect ratio, unless Crop is set. With neither set, the
+	// full size image is downloaded. Ignored for videos, which are always
+	// downloaded at their original quality with `=dv`, so a mixed pick
+	// gets sized photos and original videos.
+	Width  int
+	Height int
+	Crop   bool // crop the image to exactly Width x Height instead of fitting it within them, such as for square thumbnails. Requires both Width and Height
+
+	// Original downloads the original image bytes with `=d`, keeping the
+	// EXIF metadata that Google strips when resizing. Width, Height and Crop
+	// are ignored. Originals are larger than resized images, so this uses
+	// more bandwidth and storage, and `=d` may not be available for every
+	// account type.
+	Original bool
+
+	// RateLimit is the most media downloads to start per second, to stay
+	// under Google's per-minute quota. All the downloads made with the same
+	// credentials share one limit, so concurrent uploads don't add up; if
+	// they set different rates, the latest one applies to all of them.
+	// Defaults to 0, no limit.
+	RateLimit float64
+
+	// ConvertHEIC downloads HEIC and HEIF photos, as taken by iPhones, as
+	// JPEGs using the `-rj` option, for viewers that can't open HEIC.
+	// Their content type and the extension of their key or filename become
+	// `image/jpeg` and `.jpg`. It takes precedence over Original for HEIC
+	// photos. The paired video of a Live Photo isn't available from the
+	// Picker API. Defaults to false, downloading them as-is.
+	ConvertHEIC bool
+
+	// PerItemTimeout is the longest a single item may take, from starting
+	// its download until it's completely stored, so a stalled download
+	// fails instead of holding up the others. Defaults to 0, no timeout.
+	PerItemTimeout time.Duration
+
+	// RefreshExpiredURLs retries a download that fails with a 401 or 403
+	// once, with a fresh base URL listed from PickerSession. Base URLs expire
+	// about an hour after they're listed, so long uploads of a big pick can
+	// otherwise fail partway through. Requires PickerSession. Defaults to
+	// false.
+	RefreshExpiredURLs bool
+	PickerSession      *GooglePhotosPickerSession // session the items were picked in, used by RefreshExpiredURLs
+
+	// MaxItems and MaxTotalBytes cap a run to protect against an
+	// accidentally huge pick, returning a *LimitError. A run with more
+	// than MaxItems items fails before anything is downloaded. Once more
+	// than MaxTotalBytes have been downloaded, no more items are started;
+	// items already in progress finish and are kept, along with everything
+	// stored before them, and the photos json isn't written. Default to 0,
+	// no limit.
+	MaxItems      int
+	MaxTotalBytes int64
+}
+
+// ErrLimitExceeded is matched by a *LimitError with errors.Is
+var ErrLimitExceeded = errors.New("download limit exceeded")
+
+// LimitError is returned when a run hits DownloadOptions.MaxItems or
+// MaxTotalBytes, with the counts so far.
+type LimitError struct {
+	Limit string // The limit that was hit, `MaxItems` or `MaxTotalBytes`
+	Items int    // Number of items in the run for MaxItems, or downloaded so far for MaxTotalBytes
+	Bytes int64  // Number of bytes downloaded so far
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s (%d items, %d bytes)", ErrLimitExceeded, e.Limit, e.Items, e.Bytes)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// checkItems returns a *LimitError if a run of n items is over MaxItems
+func (o DownloadOptions) checkItems(n int) error {
+	if o.MaxItems > 0 && n > o.MaxItems {
+		return &LimitError{Limit: "MaxItems", Items: n}
+	}
+	return nil
+}
+
+// checkBytes returns a *LimitError once the bytes downloaded so far are
+// over MaxTotalBytes
+func (o DownloadOptions) checkBytes(items int, bytes int64) error {
+	if o.MaxTotalBytes > 0 && bytes > o.MaxTotalBytes {
+		return &LimitError{Limit: "MaxTotalBytes", Items: items, Bytes: bytes}
+	}
+	return nil
+}
+
+// itemContext returns the context for downloading and storing one item,
+// which is done after PerItemTimeout if it's set
+func (o DownloadOptions) itemContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.PerItemTimeout > 0 {
+		return context.WithTimeout(ctx, o.PerItemTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// poolOptions configure storeAll
+type poolOptions struct {
+	concurrency int  // number of items to store at once, defaults to 4
+	failFast    bool // stop at the first failed item, returning only its error
+
+	// onResult is called after each item is stored, skipped or fails, with
+	// the number of items done so far. Calls are never made concurrently.
+	onResult func(result UploadResult, done int)
+}
+
+// storeAll runs store for each of the items with its key on a pool of
+// workers, keeping to the MaxItems and MaxTotalBytes limits. Unless
+// failFast is set, every item is attempted and all the errors are returned
+// together. No new items are started once ctx is done or a limit is hit,
+// and their results have that error.
+func (o DownloadOptions) storeAll(ctx context.Context, items []GooglePhotosPickedItem, keys []string, pool poolOptions, store func(ctx context.Context, item GooglePhotosPickedItem, key string) UploadResult) ([]UploadResult, error) {
+	if err := o.checkItems(len(items)); err != nil {
+		return nil, err
+	}
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	workers := pool.concurrency
+	if workers < 1 {
+		workers = 4
+	}
+
+	results := make([]UploadResult, len(items))
+	for i, item := range items {
+		results[i] = UploadResult{Item: item, Key: keys[i]}
+	}
+
+	var mu sync.Mutex
+	var errs []error
+	finished := make([]bool, len(items))
+	done := 0
+	var total int64
+	var limitErr error
+	limited := make(chan struct{}) // closed once a limit is hit, so no more items are started
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if workerCtx.Err() != nil {
+					continue // cancelled while it was being dispatched
+				}
+				result := store(workerCtx, items[i], keys[i])
+				mu.Lock()
+				results[i] = result
+				finished[i] = true
+				if result.Err != nil {
+					errs = append(errs, fmt.Errorf("error storing %s at %s: %w", result.Item.ID, result.Key, result.Err))
+					if pool.failFast {
+						cancel()
+					}
+				}
+				total += result.Bytes
+				if limitErr == nil {
+					if limitErr = o.checkBytes(done+1, total); limitErr != nil {
+						close(limited)
+					}
+				}
+				done++
+				if pool.onResult != nil {
+					pool.onResult(result, done)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for i := range items {
+		select {
+		case jobs <- i:
+		case <-limited:
+			break dispatch
+		case <-workerCtx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// items that were never started failed because of the limit or the
+	// cancellation
+	for i := range results {
+		if finished[i] {
+			continue
+		}
+		if limitErr != nil {
+			results[i].Err = limitErr
+		} else {
+			results[i].Err = workerCtx.Err()
+		}
+	}
+	if limitErr != nil {
+		return results, errors.Join(append([]error{limitErr}, errs...)...)
+	}
+	if pool.failFast && len(errs) > 0 {
+		return results, errs[0]
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return results, errors.Join(errs...)
+}
+
+// Validate checks that the options can be used to build a download URL
+func (o DownloadOptions) Validate() error {
+	if o.Original {
+		return nil
+	}
+	if o.Width < 0 || o.Height < 0 {
+		return fmt.Errorf("invalid download size %dx%d: width and height can't be negative", o.Width, o.Height)
+	}
+	if o.Crop && (o.Width == 0 || o.Height == 0) {
+		return fmt.Errorf("invalid download size %dx%d: crop needs both a width and a height", o.Width, o.Height)
+	}
+	return nil
+}
+
+// mediaURL returns the URL to download the item's media from
+func (o DownloadOptions) mediaURL(item GooglePhotosPickedItem) string {
+	if item.Type.IsVideo() {
+		// videos need `=dv` to download the video bytes instead of a thumbnail
+		return fmt.Sprintf("%s=dv", item.Media.BaseURL)
+	}
+	if o.convertHEIC(item) {
+		if sized := SizedURL(item.Media.BaseURL, o); sized != item.Media.BaseURL {
+			return sized + "-rj"
+		}
+		// s0 is the full size
+		return fmt.Sprintf("%s=s0-rj", item.Media.BaseURL)
+	}
+	if o.Original {
+		return fmt.Sprintf("%s=d", item.Media.BaseURL)
+	}
+	return SizedURL(item.Media.BaseURL, o)
+}
+
+// convertHEIC reports whether the item is downloaded as a JPEG instead of HEIC
+func (o DownloadOptions) convertHEIC(item GooglePhotosPickedItem) bool {
+	return o.ConvertHEIC && item.IsHEIC()
+}
+
+// contentType returns the content type of the item's downloaded media
+func (o DownloadOptions) contentType(item GooglePhotosPickedItem) string {
+	if o.convertHEIC(item) {
+		return "image/jpeg"
+	}
+	return item.Media.MimeType
+}
+
+// filename returns the item's filename, with a `.jpg` extension if it's
+// converted from HEIC
+func (o DownloadOptions) filename(item GooglePhotosPickedItem) string {
+	name := item.Media.Filename
+	if o.convertHEIC(item) && name != "" {
+		return strings.TrimSuffix(name, path.Ext(name)) + ".jpg"
+	}
+	return name
+}
+
+// SizedURL returns the URL to fetch an image at the size in opts, such as
+// `baseURL=w2048` or `baseURL=w2048-h1024`. When both width and height are
+// set, Google fits the image within them keeping its aspect ratio, or
+// crops it to exactly that size when Crop is set (`-c`). With
+// neither set, baseURL is returned as-is for the full size image.
+// Negative sizes are treated as unset, and Crop is ignored without both a
+// width and a height; use Validate to reject them instead.
+func SizedURL(baseURL string, opts DownloadOptions) string {
+	opts.Width, opts.Height = max(opts.Width, 0), max(opts.Height, 0)
+	switch {
+	case opts.Width != 0 && opts.Height != 0 && opts.Crop:
+		return fmt.Sprintf("%s=w%d-h%d-c", baseURL, opts.Width, opts.Height)
+	case opts.Width != 0 && opts.Height != 0:
+		return fmt.Sprintf("%s=w%d-h%d", baseURL, opts.Width, opts.Height)
+	case opts.Width != 0:
+		return fmt.Sprintf("%s=w%d", baseURL, opts.Width)
+	case opts.Height != 0:
+		return fmt.Sprintf("%s=h%d", baseURL, opts.Height)
+	}
+	return baseURL
+}
+
+// Download fetches the item's media from Google Photos and streams it to w.
+func (c *Credentials) Download(ctx context.Context, item GooglePhotosPickedItem, opts DownloadOptions, w io.Writer) error {
+	ctx, cancel := opts.itemContext(ctx)
+	defer cancel()
+	body, err := c.openMedia(ctx, item, opts)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// openMedia starts downloading the item's media, returning the body to
+// read it from. The caller must close the body.
+func (c *Credentials) openMedia(ctx context.Context, item GooglePhotosPickedItem, opts DownloadOptions) (io.ReadCloser, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if err := c.wait(ctx, limitDownloads, opts.RateLimit); err != nil {
+		return nil, err
+	}
+	token, err := c.TokenContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	uri := opts.mediaURL(item)
+	response, err := c.httpRequest(ctx, token.AccessToken,
+		"GET",
+		uri,
+		nil,
+	)
+	logResponse(c.logger(), "GET", uri, response, err)
+	if err != nil {
+		return nil, err
+	}
+	expired := response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden
+	if expired && opts.RefreshExpiredURLs && opts.PickerSession != nil {
+		response.Body.Close()
+		baseURL, err := opts.PickerSession.freshBaseURL(ctx, item.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error refreshing the base url of %s: %w", item.ID, err)
+		}
+		item.Media.BaseURL = baseURL
+		// only retry once, in case the failure wasn't an expired url
+		opts.RefreshExpiredURLs = false
+		return c.openMedia(ctx, item, opts)
+	}
+	if !successStatus(response.StatusCode) {
+		defer response.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+		return nil, fmt.Errorf("error downloading %s: %w", item.ID, responseError(response, data))
+	}
+	if response.ContentLength >= 0 {
+		return &lengthCheckingReader{ReadCloser: response.Body, id: item.ID, expected: response.ContentLength}, nil
+	}
+	return response.Body, nil
+}
+
+// ErrIncompleteDownload is returned when a download ends before the
+// Content-Length that Google sent. Uploads are aborted when it happens,
+// so no truncated object is stored.
+var ErrIncompleteDownload = errors.New("download ended before its content length")
+
+// lengthCheckingReader returns ErrIncompleteDownload when the body ends
+// before the expected number of bytes have been read
+type lengthCheckingReader struct {
+	io.ReadCloser
+	id       string
+	expected int64
+	n        int64
+}
+
+func (l *lengthCheckingReader) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	l.n += int64(n)
+	if (err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF)) && l.n < l.expected {
+		return n, fmt.Errorf("error downloading %s: got %d of %d bytes: %w", l.id, l.n, l.expected, ErrIncompleteDownload)
+	}
+	return n, err
+}
+
+// detectContentType returns contentType, or when it's missing or generic,
+// the type for the filename's extension or else the type sniffed from the
+// start of r. The returned reader must be read instead of r.
+func detectContentType(r io.Reader, contentType string, filename string) (io.Reader, string) {
+	if contentType != "" && contentType != "application/octet-stream" {
+		return r, contentType
+	}
+	if byExtension := mime.TypeByExtension(path.Ext(filename)); byExtension != "" {
+		return r, byExtension
+	}
+	buffered := bufio.NewReaderSize(r, 512)
+	// a short read still has what there is to sniff
+	start, _ := buffered.Peek(512)
+	return buffered, http.DetectContentType(start)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,200 @@
+package gphotos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tokenCredentials returns credentials with an access token that doesn't
+// need refreshing
+func tokenCredentials() *Credentials {
+	return &Credentials{
+		RefreshToken: "refresh",
+		AccessToken:  &Token{AccessToken: "token", ExpiresAt: time.Now().Add(time.Hour)},
+		Retry:        fastRetry,
+	}
+}
+
+func TestDownloadShorterThanContentLength(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("only part of it"))
+	}))
+	defer server.Close()
+	item := pickedItem("a", "a.jpg")
+	item.Media.BaseURL = server.URL + "/media"
+
+	var buf bytes.Buffer
+	err := tokenCredentials().Download(context.Background(), item, DownloadOptions{}, &buf)
+	if !errors.Is(err, ErrIncompleteDownload) {
+		t.Errorf("got error %v, want ErrIncompleteDownload", err)
+	}
+}
+
+func TestDownloadRefreshesExpiredURL(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/mediaItems":
+			fmt.Fprintf(w, `{"mediaItems":[{"id":"a","mediaFile":{"baseUrl":"%s/fresh","filename":"a.jpg"}}]}`, server.URL)
+		case "/expired":
+			http.Error(w, "expired", http.StatusForbidden)
+		case "/fresh":
+			w.Write([]byte("photo"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	c := tokenCredentials()
+	c.PickerBaseURL = server.URL + "/v1"
+	item := pickedItem("a", "a.jpg")
+	item.Media.BaseURL = server.URL + "/expired"
+	opts := DownloadOptions{
+		RefreshExpiredURLs: true,
+		PickerSession:      &GooglePhotosPickerSession{ID: "session", Credentials: c},
+	}
+
+	var buf bytes.Buffer
+	if err := c.Download(context.Background(), item, opts, &buf); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if buf.String() != "photo" {
+		t.Errorf("downloaded %q, want the photo from the fresh url", buf.String())
+	}
+}
+
+func TestSizedURL(t *testing.T) {
+	tests := []struct {
+		name string
+		opts DownloadOptions
+		want string
+	}{
+		{"full size", DownloadOptions{}, "https://photo"},
+		{"width only", DownloadOptions{Width: 2048}, "https://photo=w2048"},
+		{"height only", DownloadOptions{Height: 1024}, "https://photo=h1024"},
+		{"negative width", DownloadOptions{Width: -1}, "https://photo"},
+		{"crop without both", DownloadOptions{Width: 256, Crop: true}, "https://photo=w256"},
+		{"width and height", DownloadOptions{Width: 2048, Height: 1024}, "https://photo=w2048-h1024"},
+		{"crop", DownloadOptions{Width: 256, Height: 256, Crop: true}, "https://photo=w256-h256-c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SizedURL("https://photo", tt.opts); got != tt.want {
+				t.Errorf("SizedURL = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMediaURLVideoAndPhoto(t *testing.T) {
+	photo := pickedItem("p", "p.jpg")
+	photo.Media.BaseURL = "https://photo"
+	video := GooglePhotosPickedItem{ID: "v", Type: TypeVideo, Media: GooglePhotosPickedMedia{BaseURL: "https://video", Filename: "v.mp4"}}
+
+	opts := DownloadOptions{}
+	if got := opts.mediaURL(video); got != "https://video=dv" {
+		t.Errorf("video url = %s, want =dv", got)
+	}
+	if got := opts.mediaURL(photo); got != "https://photo" {
+		t.Errorf("photo url = %s, want the base url", got)
+	}
+	opts.Original = true
+	if got := opts.mediaURL(video); got != "https://video=dv" {
+		t.Errorf("video url with Original = %s, want =dv", got)
+	}
+}
+
+func TestMediaURLMixedSizing(t *testing.T) {
+	items := []GooglePhotosPickedItem{
+		{ID: "p1", Type: TypePhoto, Media: GooglePhotosPickedMedia{BaseURL: "https://p1"}},
+		{ID: "v1", Type: TypeVideo, Media: GooglePhotosPickedMedia{BaseURL: "https://v1"}},
+		{ID: "p2", Type: TypePhoto, Media: GooglePhotosPickedMedia{BaseURL: "https://p2"}},
+	}
+	want := []string{"https://p1=w2048-h2048", "https://v1=dv", "https://p2=w2048-h2048"}
+	opts := DownloadOptions{Width: 2048, Height: 2048}
+	for i, item := range items {
+		if got := opts.mediaURL(item); got != want[i] {
+			t.Errorf("%s url = %s, want %s", item.ID, got, want[i])
+		}
+	}
+}
+
+// countingTransport counts the requests sent through it
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestDownloadUsesHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("photo"))
+	}))
+	defer server.Close()
+	transport := &countingTransport{}
+	c := tokenCredentials()
+	c.HTTPClient = &http.Client{Transport: transport}
+	item := pickedItem("a", "a.jpg")
+	item.Media.BaseURL = server.URL + "/media"
+
+	var buf bytes.Buffer
+	if err := c.Download(context.Background(), item, DownloadOptions{}, &buf); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if n := transport.requests.Load(); n != 1 {
+		t.Errorf("HTTPClient sent %d requests, want 1", n)
+	}
+}
+
+func TestRateLimitSharedPerPurpose(t *testing.T) {
+	c := tokenCredentials()
+	ctx := context.Background()
+	start := time.Now()
+	// nearly equal rates still share one limit
+	for _, perSecond := range []float64{20, 20.0001, 20} {
+		if err := c.wait(ctx, limitDownloads, perSecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("3 downloads at 20/s started within %s, want them spread out", elapsed)
+	}
+
+	start = time.Now()
+	if err := c.wait(ctx, limitAPI, 20); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("an API request waited %s on the download limit", elapsed)
+	}
+}
+
+func TestStoreAllFailFast(t *testing.T) {
+	items := []GooglePhotosPickedItem{pickedItem("a", ""), pickedItem("b", ""), pickedItem("c", "")}
+	failed := errors.New("failed")
+	stored := 0
+	results, err := DownloadOptions{}.storeAll(context.Background(), items, []string{"a", "b", "c"}, poolOptions{concurrency: 1, failFast: true},
+		func(ctx context.Context, item GooglePhotosPickedItem, key string) UploadResult {
+			stored++
+			return UploadResult{Item: item, Key: key, Err: failed}
+		})
+	if !errors.Is(err, failed) || stored != 1 {
+		t.Fatalf("got error %v after %d items, want the first failure only", err, stored)
+	}
+	for _, r := range results[1:] {
+		if !errors.Is(r.Err, context.Canceled) {
+			t.Errorf("%s got error %v, want it cancelled", r.Item.ID, r.Err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package gphotos
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuotaError is returned when a Google Photos API quota has been exceeded.
+// Use errors.As to check for it and back off until RetryAt.
+type QuotaError struct {
+	RetryAt time.Time          // When the request may be retried. Zero if Google gave no hint
+	Err     *GooglePhotosError // The error returned by the API
+}
+
+func (e *QuotaError) Error() string {
+	if e.RetryAt.IsZero() {
+		return fmt.Sprintf("quota exceeded: %s", e.Err.Message)
+	}
+	return fmt.Sprintf("quota exceeded, retry at %s: %s", e.RetryAt.Format(time.RFC3339), e.Err.Message)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return e.Err
+}
+
+// APIError is returned for an unsuccessful HTTP response that doesn't
+// contain a json error, such as an HTML page from a gateway.
+type APIError struct {
+	StatusCode int    // HTTP status code of the response
+	Status     string // HTTP status of the response, such as `502 Bad Gateway`
+	Body       string // The start of the response body
+}
+
+func (e *APIError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("unexpected response: %s", e.Status)
+	}
+	return fmt.Sprintf("unexpected response: %s: %s", e.Status, e.Body)
+}
+
+// ParseError is returned when a response from Google can't be parsed,
+// such as after an API change. Body holds the raw response for logging.
+type ParseError struct {
+	Body []byte // The raw response body
+	Err  error  // The json error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("error parsing response: %v", e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// maxErrorBody is how much of a response body is kept in an APIError
+const maxErrorBody = 512
+
+// successStatus reports whether an HTTP status code is a 2xx success
+func successStatus(code int) bool {
+	return code >= 200 && code <= 299
+}
+
+// responseError returns the error for an unsuccessful response with the
+// given body: the GooglePhotosError in the body if there is one, otherwise
+// an APIError with the status and the start of the body.
+func responseError(response *http.Response, data []byte) error {
+	var resp struct {
+		Error *GooglePhotosError `json:"error"`
+	}
+	if err := json.Unmarshal(data, &resp); err == nil && resp.Error != nil {
+		return apiError(response, resp.Error)
+	}
+	body := strings.TrimSpace(string(data))
+	if len(body) > maxErrorBody {
+		body = body[:maxErrorBody] + "..."
+	}
+	return &APIError{
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+		Body:       body,
+	}
+}
+
+// apiError converts an error found in an API response body into the error
+// returned to callers. Quota errors become a QuotaError with the reset time
+// taken from the error details or the Retry-After header.
+func apiError(response *http.Response, e *GooglePhotosError) error {
+	if e.Code != http.StatusTooManyRequests && e.Status != "RESOURCE_EXHAUSTED" {
+		return e
+	}
+	quotaErr := &QuotaError{Err: e}
+	if delay, ok := e.RetryAfter(); ok {
+		quotaErr.RetryAt = time.Now().Add(delay)
+	} else if at, ok := retryAfter(response.Header); ok {
+		quotaErr.RetryAt = at
+	}
+	return quotaErr
+}
+
+// sessionError wraps err with ErrSessionNotFound when the session
+// endpoint responded with a 404, so callers can create a new session
+// instead of retrying.
+func sessionError(response *http.Response, err error) error {
+	if err == nil || response.StatusCode != http.StatusNotFound {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrSessionNotFound, err)
+}
+
+// ErrorDetail is an entry in the details of a GooglePhotosError. Fields
+// are only set for the detail types noted next to them.
+type ErrorDetail struct {
+	Type       string            `json:"@type"`      // Type URL of the detail, such as `type.googleapis.com/google.rpc.RetryInfo`
+	RetryDelay string            `json:"retryDelay"` // google.rpc.RetryInfo: how long to wait before retrying, such as `30s`
+	Reason     string            `json:"reason"`     // google.rpc.ErrorInfo: reason for the error, such as `RATE_LIMIT_EXCEEDED`
+	Domain     string            `json:"domain"`     // google.rpc.ErrorInfo: service that produced the error
+	Metadata   map[string]string `json:"metadata"`   // google.rpc.ErrorInfo: more information, such as `quota_metric`
+	Violations []QuotaViolation  `json:"violations"` // google.rpc.QuotaFailure: the quotas that were exceeded
+}
+
+// QuotaViolation describes a single quota that was exceeded
+type QuotaViolation struct {
+	Subject     string `json:"subject"`
+	Description string `json:"description"`
+}
+
+// ErrorDetails parses the error's details into typed entries.
+// Details that can't be parsed are skipped.
+func (e *GooglePhotosError) ErrorDetails() []ErrorDetail {
+	list, ok := e.Details.([]any)
+	if !ok {
+		return nil
+	}
+	details := []ErrorDetail{}
+	for _, d := range list {
+		data, err := json.Marshal(d)
+		if err != nil {
+			continue
+		}
+		var detail ErrorDetail
+		if err := json.Unmarshal(data, &detail); err != nil {
+			continue
+		}
+		details = append(details, detail)
+	}
+	return details
+}
+
+// RetryAfter returns the retry delay from the error's
+// `google.rpc.RetryInfo` detail, if there is one.
+func (e *GooglePhotosError) RetryAfter() (time.Duration, bool) {
+	for _, d := range e.ErrorDetails() {
+		if !strings.HasSuffix(d.Type, "google.rpc.RetryInfo") {
+			continue
+		}
+		delay, err := time.ParseDuration(d.RetryDelay)
+		if err != nil {
+			return 0, false
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// QuotaMetric returns the name of the quota that was exceeded, taken from
+// the error's `google.rpc.ErrorInfo` or `google.rpc.QuotaFailure` details.
+func (e *GooglePhotosError) QuotaMetric() (string, bool) {
+	for _, d := range e.ErrorDetails() {
+		if metric := d.Metadata["quota_metric"]; metric != "" {
+			return metric, true
+		}
+		for _, v := range d.Violations {
+			if v.Subject != "" {
+				return v.Subject, true
+			}
+		}
+	}
+	return "", false
+}
+
+// retryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func retryAfter(header http.Header) (time.Time, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Now().Add(time.Duration(seconds) * time.Second), true
+	}
+	at, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return at, true
+}
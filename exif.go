@@ -0,0 +1,99 @@
+package gphotos
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	exifTagExifIFD            = 0x8769
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+	exifTypeASCII             = 2
+	exifTypeLong              = 4
+)
+
+// withCaptureTime returns a reader that streams the image in r with an
+// EXIF segment inserted that records t as the DateTimeOriginal. The EXIF
+// segment is placed after the JFIF header, if there is one.
+//
+// Images that aren't JPEGs, or JPEGs that already have EXIF data, are
+// passed through unchanged.
+func withCaptureTime(r io.Reader, t time.Time) io.Reader {
+	br := bufio.NewReader(r)
+	soi, err := br.Peek(2)
+	if err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return br
+	}
+	head := make([]byte, 2)
+	io.ReadFull(br, head)
+
+	// keep the JFIF (APP0) segment first, as readers expect
+	if marker, err := br.Peek(4); err == nil && marker[0] == 0xFF && marker[1] == 0xE0 {
+		app0 := make([]byte, 2+int(binary.BigEndian.Uint16(marker[2:])))
+		n, err := io.ReadFull(br, app0)
+		head = append(head, app0[:n]...)
+		if err != nil {
+			return io.MultiReader(bytes.NewReader(head), br)
+		}
+	}
+
+	if marker, err := br.Peek(10); err == nil && marker[0] == 0xFF && marker[1] == 0xE1 &&
+		string(marker[4:10]) == "Exif\x00\x00" {
+		return io.MultiReader(bytes.NewReader(head), br)
+	}
+	head = append(head, exifSegment(t)...)
+	return io.MultiReader(bytes.NewReader(head), br)
+}
+
+// exifSegment builds a JPEG APP1 segment holding a minimal big-endian
+// TIFF structure: IFD0 points to an Exif IFD that contains only
+// DateTimeOriginal and OffsetTimeOriginal.
+func exifSegment(t time.Time) []byte {
+	dateTime := t.Format("2006:01:02 15:04:05") + "\x00"
+	offsetTime := t.Format("-07:00") + "\x00"
+
+	const (
+		ifd0Offset = 8                       // right after the TIFF header
+		exifOffset = ifd0Offset + 2 + 12 + 4 // IFD0 has one entry
+		dataOffset = exifOffset + 2 + 24 + 4 // Exif IFD has two entries
+	)
+
+	tiff := &bytes.Buffer{}
+	write := func(v any) { binary.Write(tiff, binary.BigEndian, v) }
+	entry := func(tag, typ uint16, count, value uint32) {
+		write(tag)
+		write(typ)
+		write(count)
+		write(value)
+	}
+
+	// TIFF header
+	tiff.WriteString("MM")
+	write(uint16(42))
+	write(uint32(ifd0Offset))
+
+	// IFD0
+	write(uint16(1))
+	entry(exifTagExifIFD, exifTypeLong, 1, exifOffset)
+	write(uint32(0))
+
+	// Exif IFD
+	write(uint16(2))
+	entry(exifTagDateTimeOriginal, exifTypeASCII, uint32(len(dateTime)), dataOffset)
+	entry(exifTagOffsetTimeOriginal, exifTypeASCII, uint32(len(offsetTime)), dataOffset+uint32(len(dateTime)))
+	write(uint32(0))
+
+	tiff.WriteString(dateTime)
+	tiff.WriteString(offsetTime)
+
+	segment := &bytes.Buffer{}
+	segment.Write([]byte{0xFF, 0xE1})
+	binary.Write(segment, binary.BigEndian, uint16(2+6+tiff.Len()))
+	segment.WriteString("Exif\x00\x00")
+	segment.Write(tiff.Bytes())
+	return segment.Bytes()
+}
@@ -6,6 +6,7 @@ require (
 	github.com/alexflint/go-arg v1.5.1
 	github.com/aws/aws-sdk-go v1.55.6
 	golang.org/x/oauth2 v0.26.0
+	golang.org/x/time v0.11.0
 )
 
 require (
@@ -0,0 +1,135 @@
+package gphotos
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// OrderBy is the order that picked items are processed in.
+type OrderBy int
+
+const (
+	PickOrder   OrderBy = iota // The order returned by Google, which is the order the user picked them
+	CreatedAsc                 // Oldest create time first
+	CreatedDesc                // Newest create time first
+	FilenameAsc                // Alphabetically by filename
+)
+
+// SortItems sorts items in place into the given order. The sort is
+// stable, so items that compare equal stay in pick order. Items with a
+// missing or unparseable create time sort as the oldest.
+func SortItems(items []GooglePhotosPickedItem, order OrderBy) {
+	switch order {
+	case CreatedAsc:
+		slices.SortStableFunc(items, func(a, b GooglePhotosPickedItem) int {
+			return createTime(a).Compare(createTime(b))
+		})
+	case CreatedDesc:
+		slices.SortStableFunc(items, func(a, b GooglePhotosPickedItem) int {
+			return createTime(b).Compare(createTime(a))
+		})
+	case FilenameAsc:
+		slices.SortStableFunc(items, func(a, b GooglePhotosPickedItem) int {
+			return cmp.Compare(a.Media.Filename, b.Media.Filename)
+		})
+	}
+}
+
+// CreateTimeParsed parses the item's RFC3339 CreateTime. If Google didn't
+// provide a create time, the zero time is returned with no error.
+func (item GooglePhotosPickedItem) CreateTimeParsed() (time.Time, error) {
+	if item.CreateTime == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, item.CreateTime)
+}
+
+// createTime parses the item's create time, returning the zero time
+// if it's missing or can't be parsed.
+func createTime(item GooglePhotosPickedItem) time.Time {
+	t, _ := item.CreateTimeParsed()
+	return t
+}
+
+// String summarizes the item, such as `AF1QipM3 IMG_0001.jpg (PHOTO 4032x3024)`
+func (item GooglePhotosPickedItem) String() string {
+	m := item.Media.Metadata
+	if m.Width != 0 && m.Height != 0 {
+		return fmt.Sprintf("%s %s (%s %dx%d)", shortID(item.ID), item.Media.Filename, item.Type, m.Width, m.Height)
+	}
+	return fmt.Sprintf("%s %s (%s)", shortID(item.ID), item.Media.Filename, item.Type)
+}
+
+// shortID returns the first 8 characters of an ID, enough to tell items apart
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// IsHEIC reports whether the item is a HEIC or HEIF image, the format
+// iPhones take photos in by default.
+func (item GooglePhotosPickedItem) IsHEIC() bool {
+	switch strings.ToLower(item.Media.MimeType) {
+	case "image/heic", "image/heif", "image/heic-sequence", "image/heif-sequence":
+		return true
+	}
+	return false
+}
+
+// FilterByType returns the items that have one of the given media types,
+// keeping their order. Types are compared regardless of casing. Items with
+// no or an unknown type from Google are treated as TypeUnspecified, so pass
+// TypeUnspecified to keep them.
+func FilterByType(items []GooglePhotosPickedItem, types ...MediaType) []GooglePhotosPickedItem {
+	filtered := []GooglePhotosPickedItem{}
+	for _, item := range items {
+		itemType := item.Type.normalize()
+		if slices.ContainsFunc(types, func(t MediaType) bool { return t.normalize() == itemType }) {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// FilterByCreateTime returns the items created at or after after and
+// before before, keeping their order. A zero after or before leaves that
+// end of the range open. Items with a missing or unparseable create time
+// are kept only if includeUnknown is set.
+func FilterByCreateTime(items []GooglePhotosPickedItem, after, before time.Time, includeUnknown bool) []GooglePhotosPickedItem {
+	filtered := []GooglePhotosPickedItem{}
+	for _, item := range items {
+		t := createTime(item)
+		switch {
+		case t.IsZero():
+			if !includeUnknown {
+				continue
+			}
+		case !after.IsZero() && t.Before(after):
+			continue
+		case !before.IsZero() && !t.Before(before):
+			continue
+		}
+		filtered = append(filtered, item)
+	}
+	return filtered
+}
+
+// DedupeItems returns the items with duplicate IDs removed, keeping the
+// first occurrence of each and the order of the kept items.
+func DedupeItems(items []GooglePhotosPickedItem) []GooglePhotosPickedItem {
+	seen := map[string]bool{}
+	deduped := []GooglePhotosPickedItem{}
+	for _, item := range items {
+		if seen[item.ID] {
+			continue
+		}
+		seen[item.ID] = true
+		deduped = append(deduped, item)
+	}
+	return deduped
+}
@@ -0,0 +1,143 @@
+package gphotos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirStorage is a Storage that writes to a directory on the local disk.
+// Keys are paths relative to Dir, and can't point outside of it.
+type DirStorage struct {
+	Dir string // Required. directory to write files to, created if it doesn't exist
+}
+
+func (d DirStorage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	name, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	// write to a temp file and rename it into place, so a crash or a failed
+	// download never leaves a truncated file behind
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func (d DirStorage) PutJSON(ctx context.Context, key string, v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return d.Put(ctx, key, bytes.NewReader(buf), "application/json")
+}
+
+// path returns the file path for key, making sure it stays inside Dir
+func (d DirStorage) path(key string) (string, error) {
+	rel := strings.TrimLeft(filepath.FromSlash(key), string(filepath.Separator))
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("invalid key %q: it points outside of %s", key, d.Dir)
+	}
+	return filepath.Join(d.Dir, rel), nil
+}
+
+// DirOptions configure how photos are downloaded to a local directory
+type DirOptions struct {
+	DownloadOptions // how media is requested from Google Photos, such as Width and Height
+
+	Concurrency int // number of photos to download at once, defaults to 4
+
+	// OnProgress is called after each photo is downloaded or fails, with
+	// the number of photos done so far out of the total. err is set if the
+	// photo failed. Calls are never made concurrently.
+	OnProgress func(item GooglePhotosPickedItem, done, total int, err error)
+}
+
+// DownloadToDir downloads each of the photos into dir, named by their
+// original filename, and writes a `photos.json` manifest of the photos
+// that were downloaded. Each filename gets a short suffix from the ID,
+// see S3Options.UseFilename. The directory is created if
+// needed. A failed photo doesn't stop the others; the errors of all the
+// failed photos are returned together.
+func (c *Credentials) DownloadToDir(ctx context.Context, photos []GooglePhotosPickedItem, dir string, opts DownloadOptions) error {
+	return c.DownloadToDirWithOptions(ctx, photos, dir, DirOptions{DownloadOptions: opts})
+}
+
+// DownloadToDirWithOptions is like DownloadToDir, downloading several
+// photos at once and reporting progress as configured in opts. Files are
+// written to a temporary name and renamed once complete.
+func (c *Credentials) DownloadToDirWithOptions(ctx context.Context, photos []GooglePhotosPickedItem, dir string, opts DirOptions) error {
+	if _, err := c.TokenContext(ctx); err != nil {
+		return err
+	}
+	store := DirStorage{Dir: dir}
+	keys := S3Options{DownloadOptions: opts.DownloadOptions, UseFilename: true}.keys(photos)
+	pool := poolOptions{
+		concurrency: opts.Concurrency,
+		onResult: func(result UploadResult, done int) {
+			if opts.OnProgress != nil {
+				opts.OnProgress(result.Item, done, len(photos), result.Err)
+			}
+		},
+	}
+	results, err := opts.storeAll(ctx, photos, keys, pool, func(ctx context.Context, item GooglePhotosPickedItem, key string) UploadResult {
+		n, err := c.downloadTo(ctx, store, item, key, opts.DownloadOptions)
+		return UploadResult{Item: item, Key: key, Bytes: n, Err: err}
+	})
+	if errors.Is(err, ErrLimitExceeded) {
+		return err
+	}
+
+	downloaded := []GooglePhotosPickedItem{}
+	for _, r := range results {
+		if r.Err == nil {
+			downloaded = append(downloaded, r.Item)
+		}
+	}
+	if putErr := store.PutJSON(ctx, "photos.json", downloaded); putErr != nil {
+		err = errors.Join(err, putErr)
+	}
+	return err
+}
+
+// downloadTo downloads the item's media and stores it at key, returning
+// the number of bytes downloaded
+func (c *Credentials) downloadTo(ctx context.Context, store Storage, item GooglePhotosPickedItem, key string, opts DownloadOptions) (int64, error) {
+	ctx, cancel := opts.itemContext(ctx)
+	defer cancel()
+	media, err := c.openMedia(ctx, item, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer media.Close()
+	counter := &countingReader{r: media}
+	if err := store.Put(ctx, key, counter, opts.contentType(item)); err != nil {
+		return counter.n, err
+	}
+	c.logger().Info("downloaded photo", "id", item.ID, "key", key)
+	return counter.n, nil
+}
@@ -0,0 +1,66 @@
+package gphotos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// servedItems returns picked photos whose media is served by mediaServer
+func servedItems(t *testing.T, ids ...string) []GooglePhotosPickedItem {
+	t.Helper()
+	server := mediaServer(t)
+	items := make([]GooglePhotosPickedItem, len(ids))
+	for i, id := range ids {
+		items[i] = pickedItem(id, id+".jpg")
+		items[i].Media.BaseURL = server.URL + "/" + id
+	}
+	return items
+}
+
+func TestDownloadToDir(t *testing.T) {
+	dir := t.TempDir()
+	photos := servedItems(t, "a", "b", "c")
+	progress := 0
+	opts := DirOptions{OnProgress: func(item GooglePhotosPickedItem, done, total int, err error) {
+		progress++
+		if err != nil || done != progress || total != len(photos) {
+			t.Errorf("progress %d of %d for %s: %v", done, total, item.ID, err)
+		}
+	}}
+
+	if err := tokenCredentials().DownloadToDirWithOptions(context.Background(), photos, dir, opts); err != nil {
+		t.Fatalf("DownloadToDirWithOptions: %v", err)
+	}
+	keys := S3Options{UseFilename: true}.keys(photos)
+	for i, key := range keys {
+		data, err := os.ReadFile(filepath.Join(dir, key))
+		if err != nil || string(data) != "photo /"+photos[i].ID {
+			t.Errorf("%s has %q: %v", key, data, err)
+		}
+	}
+	var manifest []GooglePhotosPickedItem
+	data, _ := os.ReadFile(filepath.Join(dir, "photos.json"))
+	if err := json.Unmarshal(data, &manifest); err != nil || len(manifest) != len(photos) {
+		t.Errorf("photos.json has %d photos: %v", len(manifest), err)
+	}
+}
+
+func TestDownloadToDirMaxTotalBytes(t *testing.T) {
+	dir := t.TempDir()
+	photos := servedItems(t, "a", "b", "c")
+	opts := DirOptions{Concurrency: 1}
+	opts.MaxTotalBytes = 10 // each photo is 9 bytes
+
+	err := tokenCredentials().DownloadToDirWithOptions(context.Background(), photos, dir, opts)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != "MaxTotalBytes" || limitErr.Items != 2 {
+		t.Fatalf("got error %v, want MaxTotalBytes after 2 photos", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "photos.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("photos.json was written after the limit: %v", err)
+	}
+}
@@ -3,6 +3,8 @@ package gphotos
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,11 +12,13 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"golang.org/x/time/rate"
 )
 
 type MediaType string
@@ -25,63 +29,309 @@ var (
 	TypeVideo       = MediaType("VIDEO")
 )
 
+// IsPhoto reports whether the media is a photo
+func (m MediaType) IsPhoto() bool {
+	return m.normalize() == TypePhoto
+}
+
+// IsVideo reports whether the media is a video
+func (m MediaType) IsVideo() bool {
+	return m.normalize() == TypeVideo
+}
+
+// UnmarshalJSON normalizes the media type's casing, and maps unknown or
+// missing types to TypeUnspecified.
+func (m *MediaType) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*m = MediaType(s).normalize()
+	return nil
+}
+
+// normalize returns the known media type matching m regardless of casing,
+// or TypeUnspecified.
+func (m MediaType) normalize() MediaType {
+	switch t := MediaType(strings.ToUpper(strings.TrimSpace(string(m)))); t {
+	case TypePhoto, TypeVideo:
+		return t
+	}
+	return TypeUnspecified
+}
+
 var (
 	ErrPollingCallbackFalse = errors.New("callback returned false, so polling was halted")
+	ErrMediaItemsNotSet     = errors.New("the user has not finished picking media items for this session")
+	ErrSessionExpired       = errors.New("the picker session has expired")
+	ErrPollTimeout          = errors.New("the user didn't finish picking within the maximum poll duration")
+	ErrSessionNotFound      = errors.New("the picker session was not found")
+	ErrItemNotInSession     = errors.New("the item is not in the picker session")
 )
 
 // GooglePhotosPickerSession represents a session where a user can
 // pick photos from the Google Photos Picker UI.
 type GooglePhotosPickerSession struct {
-	ID            string                    // ID of the session created by Google for this user
-	PickerURI     string                    // URI to send the user to pick photos
-	PollingURI    string                    `json:"-"` // URI to poll to find out when the user is done
-	PollingConfig GooglePhotosPollingConfig // Recommended polling configuration for the Polling URI from google
-	ExpireTime    time.Time                 // Time that the session expires
-	MediaItemsSet bool                      // True if the user has finished picking photos
-	Credentials   *Credentials              `json:"-"`     // Credentials used to create this session
-	Error         *GooglePhotosError        `json:"error"` // Only present if there's been an error returned by the API
+	ID            string                    `json:"id"`                      // ID of the session created by Google for this user
+	PickerURI     string                    `json:"pickerUri"`               // URI to send the user to pick photos
+	PollingURI    string                    `json:"-"`                       // URI to poll to find out when the user is done
+	PollingConfig GooglePhotosPollingConfig `json:"pollingConfig"`           // Recommended polling configuration for the Polling URI from google
+	ExpireTime    time.Time                 `json:"expireTime"`              // Time that the session expires
+	MediaItemsSet bool                      `json:"mediaItemsSet"`           // True if the user has finished picking photos
+	PickingConfig *PickingConfig            `json:"pickingConfig,omitempty"` // Limits on what the user can pick, if any were set
+	Credentials   *Credentials              `json:"-"`                       // Credentials used to create this session
+	PollOptions   PollOptions               `json:"-"`                       // Options that change how Poll behaves
+	Error         *GooglePhotosError        `json:"error"`                   // Only present if there's been an error returned by the API
+
+	urlsMu sync.Mutex
+	urls   map[string]string // fresh base URLs by item ID, see freshBaseURL
+	urlsAt time.Time         // when urls were listed
+}
+
+// String summarizes the session, such as
+// `session 1b2c3d4e (expires 2025-01-02T15:04:05Z, picking)`
+func (s *GooglePhotosPickerSession) String() string {
+	status := "picking"
+	if s.MediaItemsSet {
+		status = "media items set"
+	}
+	if s.ExpireTime.IsZero() {
+		return fmt.Sprintf("session %s (%s)", shortID(s.ID), status)
+	}
+	return fmt.Sprintf("session %s (expires %s, %s)", shortID(s.ID), s.ExpireTime.Format(time.RFC3339), status)
+}
+
+// freshBaseURL lists the session's items again to get a fresh base URL
+// for the item, since base URLs expire about an hour after they're listed.
+// Items that fail at about the same time share a single listing.
+func (s *GooglePhotosPickerSession) freshBaseURL(ctx context.Context, id string) (string, error) {
+	s.urlsMu.Lock()
+	defer s.urlsMu.Unlock()
+	if s.urls == nil || time.Since(s.urlsAt) > time.Minute {
+		urls := map[string]string{}
+		err := s.EachItem(ctx, func(item GooglePhotosPickedItem) error {
+			urls[item.ID] = item.Media.BaseURL
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		s.urls, s.urlsAt = urls, time.Now()
+	}
+	baseURL, ok := s.urls[id]
+	if !ok {
+		return "", fmt.Errorf("item %s: %w %s", id, ErrItemNotInSession, s.ID)
+	}
+	return baseURL, nil
+}
+
+// PollOptions change how a session is polled
+type PollOptions struct {
+	DeleteOnComplete bool // Delete the session once its items have been listed
+	PageSize         int  // Number of items to request per page when listing, defaults to Google's page size
+
+	// MinPollInterval is the shortest time between polls, used when
+	// Google's recommended interval is shorter or missing. Defaults to 2s.
+	MinPollInterval time.Duration
+
+	// RateLimit is the most requests for pages of items to make per
+	// second when listing. Like DownloadOptions.RateLimit it is shared by
+	// every session of the same credentials, but it is a separate limit
+	// from downloads. Defaults to 0, no limit.
+	RateLimit float64
+
+	// MaxPollDuration is the longest Poll waits for the user to finish
+	// picking before returning ErrPollTimeout. The session's expiry still
+	// applies, whichever comes first. Defaults to 0, waiting until the
+	// session expires.
+	MaxPollDuration time.Duration
 }
 
 // GooglePhotosPollingConfig is google's recommended polling config
 type GooglePhotosPollingConfig struct {
-	PollInterval Duration // How often the polling uri should be polled
-	TimeoutIn    string   // when the picker session times out
+	PollInterval Duration `json:"pollInterval"` // How often the polling uri should be polled
+	TimeoutIn    string   `json:"timeoutIn"`    // when the picker session times out
+}
+
+// PickingConfig limits what the user can pick in a picker session.
+// The Picker API can't restrict media types when picking, so use
+// FilterByType on the picked items instead.
+type PickingConfig struct {
+	MaxItemCount int64 `json:"maxItemCount,string,omitempty"` // Maximum number of items the user can pick. Defaults to Google's limit of 2000
+}
+
+// NewPickerSessionWithToken creates a picker session using an access token
+// minted elsewhere, for workers that don't have the client secret. The
+// session can be polled, listed and downloaded from while the token is
+// valid; it can't be refreshed. Use Credentials with only an AccessToken
+// for more control, such as an HTTPClient.
+func NewPickerSessionWithToken(token string, config ...PickingConfig) (*GooglePhotosPickerSession, error) {
+	c := &Credentials{AccessToken: &Token{AccessToken: token}}
+	return c.NewPickerSession(config...)
 }
 
-func (c *Credentials) NewPickerSession() (*GooglePhotosPickerSession, error) {
-	token, err := c.Token()
+// NewPickerSession creates a picker session for the user to pick photos
+// in. Optionally provide a PickingConfig to limit what can be picked.
+func (c *Credentials) NewPickerSession(config ...PickingConfig) (*GooglePhotosPickerSession, error) {
+	return c.NewPickerSessionContext(context.Background(), config...)
+}
+
+// NewPickerSessionContext is like NewPickerSession, using ctx for the token
+// fetch and the session request.
+func (c *Credentials) NewPickerSessionContext(ctx context.Context, config ...PickingConfig) (*GooglePhotosPickerSession, error) {
+	token, err := c.TokenContext(ctx)
 	if err != nil {
 		return nil, err
 	}
-	response, err := httpRequest(token.AccessToken,
+	body := []byte(`{}`)
+	if len(config) > 0 {
+		body, err = json.Marshal(struct {
+			PickingConfig PickingConfig `json:"pickingConfig"`
+		}{config[0]})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// a retried 5xx could leave an extra open session, so only retry
+	// requests that were rate limited before being handled
+	response, err := c.requestWhen(ctx, rateLimited, token.AccessToken,
 		"POST",
-		"https://photospicker.googleapis.com/v1/sessions",
-		bytes.NewBuffer([]byte(`{}`)))
+		c.pickerURL("/sessions"),
+		body)
 	if err != nil {
 		return nil, err
 	}
 	defer response.Body.Close()
 
-	gpResponse, _, err := httpReadResponse[GooglePhotosPickerSession](response.Body)
+	gpResponse, err := readAPIResponse[GooglePhotosPickerSession](response)
+	if err != nil {
+		return nil, err
+	}
+	if gpResponse.Error != nil {
+		return nil, apiError(response, gpResponse.Error)
+	}
+
+	gpResponse.PollingURI = c.pickerURL(fmt.Sprintf("/sessions/%s", gpResponse.ID))
+	gpResponse.Credentials = c
+	return gpResponse, nil
+}
+
+// Inspect fetches an existing session by ID and lists the items the user
+// picked, without downloading or uploading anything. Use it to preview a
+// pick before syncing it. Returns ErrMediaItemsNotSet if the user hasn't
+// finished picking.
+func (c *Credentials) Inspect(ctx context.Context, sessionID string) ([]GooglePhotosPickedItem, error) {
+	s, err := c.ResumeSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return s.Items(ctx)
+}
+
+// ResumeSession fetches the current state of an existing session by ID,
+// so a session can be polled or listed after a restart, or from a
+// stateless handler that only saved the session ID.
+func (c *Credentials) ResumeSession(ctx context.Context, sessionID string) (*GooglePhotosPickerSession, error) {
+	token, err := c.TokenContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pollingURI := c.pickerURL(fmt.Sprintf("/sessions/%s", url.PathEscape(sessionID)))
+	response, err := c.request(ctx, token.AccessToken,
+		"GET",
+		pollingURI,
+		nil)
 	if err != nil {
 		return nil, err
 	}
+	defer response.Body.Close()
+
+	gpResponse, err := readAPIResponse[GooglePhotosPickerSession](response)
+	if err != nil {
+		return nil, sessionError(response, err)
+	}
 	if gpResponse.Error != nil {
-		return nil, gpResponse.Error
+		return nil, sessionError(response, apiError(response, gpResponse.Error))
 	}
 
-	gpResponse.PollingURI = fmt.Sprintf("https://photospicker.googleapis.com/v1/sessions/%s", gpResponse.ID)
+	gpResponse.PollingURI = pollingURI
 	gpResponse.Credentials = c
 	return gpResponse, nil
 }
 
+// CreateSessions creates a picker session for each of the credentials,
+// with at most `concurrency` session requests in flight at once. Use
+// CreateSessionsWithOptions to also limit the rate of requests.
+//
+// The returned slices line up with creds: sessions[i] is nil when errs[i]
+// is set. Sessions not yet started when ctx is cancelled get ctx's error.
+func CreateSessions(ctx context.Context, creds []*Credentials, concurrency int) ([]*GooglePhotosPickerSession, []error) {
+	return CreateSessionsWithOptions(ctx, creds, CreateSessionsOptions{Concurrency: concurrency})
+}
+
+// CreateSessionsOptions change how CreateSessionsWithOptions creates sessions
+type CreateSessionsOptions struct {
+	Concurrency int // number of session requests in flight at once, defaults to 1
+
+	// RateLimit is the most session requests to start per second, shared
+	// by all the credentials, to smooth out a burst when onboarding many
+	// users. Each request is also retried according to its credentials'
+	// Retry policy. Defaults to 0, no limit.
+	RateLimit float64
+}
+
+// CreateSessionsWithOptions is like CreateSessions, with the concurrency
+// and rate limit set in opts. In-flight requests are cancelled with ctx.
+func CreateSessionsWithOptions(ctx context.Context, creds []*Credentials, opts CreateSessionsOptions) ([]*GooglePhotosPickerSession, []error) {
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var limiter *rate.Limiter
+	if opts.RateLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.RateLimit), 1)
+	}
+	sessions := make([]*GooglePhotosPickerSession, len(creds))
+	errs := make([]error, len(creds))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, c := range creds {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if limiter != nil {
+				if err := limiter.Wait(ctx); err != nil {
+					errs[i] = err
+					return
+				}
+			}
+			sessions[i], errs[i] = c.NewPickerSessionContext(ctx)
+		}()
+	}
+	wg.Wait()
+	return sessions, errs
+}
+
 // Poll polls the Google Photos session API until MediaItemsSet is true
-// or an error occurs.
+// or an error occurs. Polling stops with `ErrSessionExpired` once the
+// session's ExpireTime has passed, and with `ErrSessionNotFound` if the
+// session no longer exists.
 //
 // Provide a callback func if to show progress to the user or interrupt
 // the polling. Returning `false` from a callback will stop the polling
 // with an `ErrPollingCallbackFalse` error.
 func (s *GooglePhotosPickerSession) Poll(ctx context.Context, callbacks ...func(s *GooglePhotosPickerSession) bool) ([]GooglePhotosPickedItem, error) {
+	var deadline time.Time
+	if s.PollOptions.MaxPollDuration > 0 {
+		deadline = time.Now().Add(s.PollOptions.MaxPollDuration)
+	}
 	for {
 		for _, cb := range callbacks {
 			res := cb(s)
@@ -92,16 +342,30 @@ func (s *GooglePhotosPickerSession) Poll(ctx context.Context, callbacks ...func(
 		if ctx.Err() != nil {
 			return nil, ctx.Err()
 		}
-		// sleep for the recommended interval
-		time.Sleep(time.Duration(s.PollingConfig.PollInterval))
-		if ctx.Err() != nil {
+		if !s.ExpireTime.IsZero() && time.Now().After(s.ExpireTime) {
+			return nil, ErrSessionExpired
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, ErrPollTimeout
+		}
+		// wait for the recommended interval, backing off near expiry,
+		// and poll one last time at the deadline
+		interval := s.pollInterval()
+		if !deadline.IsZero() {
+			interval = min(interval, time.Until(deadline))
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
 			return nil, ctx.Err()
+		case <-timer.C:
 		}
-		token, err := s.Credentials.Token()
+		token, err := s.Credentials.TokenContext(ctx)
 		if err != nil {
 			return nil, err
 		}
-		response, err := httpRequest(token.AccessToken,
+		response, err := s.Credentials.request(ctx, token.AccessToken,
 			"GET",
 			s.PollingURI,
 			nil)
@@ -110,14 +374,15 @@ func (s *GooglePhotosPickerSession) Poll(ctx context.Context, callbacks ...func(
 		}
 		defer response.Body.Close()
 
-		resp, _, err := httpReadResponse[GooglePhotosPickerSession](response.Body)
+		resp, err := readAPIResponse[GooglePhotosPickerSession](response)
 		if err != nil {
-			return nil, err
+			return nil, sessionError(response, err)
 		}
 		response.Body.Close()
 		if resp.Error != nil {
-			return nil, resp.Error
+			return nil, sessionError(response, apiError(response, resp.Error))
 		}
+		s.Credentials.logger().Debug("polled session", "session", s.ID, "media_items_set", resp.MediaItemsSet)
 		if resp.MediaItemsSet {
 			break
 		}
@@ -132,8 +397,75 @@ func (s *GooglePhotosPickerSession) Poll(ctx context.Context, callbacks ...func(
 	}
 
 	// get all the items from this session
-	return s.listPickerContents()
-	// after this should delete the session, but leaving it in place for now
+	items, err := s.listPickerContents(ctx, &ListStats{})
+	if err != nil {
+		return nil, err
+	}
+	if s.PollOptions.DeleteOnComplete {
+		if err := s.Delete(ctx); err != nil {
+			return items, err
+		}
+	}
+	return items, nil
+}
+
+// Delete deletes the session at Google. Picked items can't be listed or
+// downloaded after the session is deleted.
+func (s *GooglePhotosPickerSession) Delete(ctx context.Context) error {
+	token, err := s.Credentials.TokenContext(ctx)
+	if err != nil {
+		return err
+	}
+	response, err := s.Credentials.request(ctx, token.AccessToken,
+		"DELETE",
+		s.PollingURI,
+		nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if !successStatus(response.StatusCode) {
+		return responseError(response, data)
+	}
+	return nil
+}
+
+// WaitForPick blocks until the user has finished picking and returns the
+// picked items. It polls at Google's recommended interval, and stops when
+// ctx is done or with `ErrSessionExpired` when the session expires. Use
+// Poll instead to report progress while waiting.
+func (s *GooglePhotosPickerSession) WaitForPick(ctx context.Context) ([]GooglePhotosPickedItem, error) {
+	return s.Poll(ctx)
+}
+
+// pollInterval returns how long to wait before the next poll. It starts
+// at Google's recommended interval, but no less than MinPollInterval, and
+// doubles each time another quarter of the session's TimeoutIn has
+// elapsed, so sessions the user abandons are polled less and less often.
+// It never waits past ExpireTime.
+func (s *GooglePhotosPickerSession) pollInterval() time.Duration {
+	minInterval := s.PollOptions.MinPollInterval
+	if minInterval <= 0 {
+		minInterval = 2 * time.Second
+	}
+	interval := max(time.Duration(s.PollingConfig.PollInterval), minInterval)
+	timeout, err := time.ParseDuration(s.PollingConfig.TimeoutIn)
+	if err != nil || timeout <= 0 || s.ExpireTime.IsZero() {
+		return interval
+	}
+	remaining := time.Until(s.ExpireTime)
+	if remaining <= 0 {
+		return interval
+	}
+	if elapsed := 1 - float64(remaining)/float64(timeout); elapsed > 0 {
+		interval <<= int(elapsed * 4)
+	}
+	return min(interval, remaining)
 }
 
 type GooglePhotosPickedItems struct {
@@ -143,28 +475,51 @@ type GooglePhotosPickedItems struct {
 }
 
 type GooglePhotosPickedItem struct {
-	ID         string
-	CreateTime string
-	Type       MediaType
+	ID         string                  `json:"id"`
+	CreateTime string                  `json:"createTime"`
+	Type       MediaType               `json:"type"`
 	Media      GooglePhotosPickedMedia `json:"mediaFile"`
+	SHA256     string                  `json:"sha256,omitempty"` // Hex SHA256 of the stored media, set by UploadToS3 for the photos json. Not returned by Google
 }
 
 type GooglePhotosPickedMedia struct {
-	BaseURL  string
-	MimeType string
-	Filename string
+	BaseURL  string                     `json:"baseUrl"`
+	MimeType string                     `json:"mimeType"`
+	Filename string                     `json:"filename"`
 	Metadata GooglePhotosPickedMetadata `json:"mediaFileMetadata"`
 }
 
 type GooglePhotosPickedMetadata struct {
-	Width       int
-	Height      int
-	CameraMake  string
-	CameraModel string
+	Width         int                        `json:"width"`
+	Height        int                        `json:"height"`
+	CameraMake    string                     `json:"cameraMake"`
+	CameraModel   string                     `json:"cameraModel"`
+	PhotoMetadata *GooglePhotosPhotoMetadata `json:"photoMetadata,omitempty"` // Only present for photos
+	VideoMetadata *GooglePhotosVideoMetadata `json:"videoMetadata,omitempty"` // Only present for videos
+}
+
+// GooglePhotosPhotoMetadata is the exposure information for a photo
+type GooglePhotosPhotoMetadata struct {
+	FocalLength     float64 `json:"focalLength"`     // Focal length of the camera lens in mm
+	ApertureFNumber float64 `json:"apertureFNumber"` // Aperture f number of the camera lens
+	IsoEquivalent   int     `json:"isoEquivalent"`   // ISO of the camera
+	ExposureTime    string  `json:"exposureTime"`    // Exposure time of the camera aperture, such as `0.008s`
+}
+
+// GooglePhotosVideoMetadata is the playback information for a video
+type GooglePhotosVideoMetadata struct {
+	Fps              float64 `json:"fps"`              // Frame rate of the video
+	ProcessingStatus string  `json:"processingStatus"` // Processing status of the video, such as `READY`
 }
 
 type Duration time.Duration
 
+// MarshalJSON writes the duration as a string like Google's, such as `5s`,
+// so it can be read back by UnmarshalJSON
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
 func (d *Duration) UnmarshalJSON(b []byte) error {
 	var str string
 	if err := json.Unmarshal(b, &str); err != nil {
@@ -178,127 +533,496 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (s *GooglePhotosPickerSession) listPickerContents() ([]GooglePhotosPickedItem, error) {
-	token, err := s.Credentials.Token()
+// Items lists all the items picked in the session, such as a session
+// fetched with ResumeSession that the user already finished. Returns
+// ErrMediaItemsNotSet if the user hasn't finished picking; use Poll to
+// wait for them instead.
+func (s *GooglePhotosPickerSession) Items(ctx context.Context) ([]GooglePhotosPickedItem, error) {
+	items, _, err := s.ItemsWithStats(ctx)
+	return items, err
+}
+
+// ListStats describes the listing of a session's items
+type ListStats struct {
+	Pages   int           // Number of pages of items fetched
+	Items   int           // Number of items listed, including duplicates
+	Elapsed time.Duration // How long listing took
+}
+
+// ItemsWithStats is like Items, and also returns stats about the listing,
+// which help with tuning PollOptions.PageSize.
+func (s *GooglePhotosPickerSession) ItemsWithStats(ctx context.Context) ([]GooglePhotosPickedItem, ListStats, error) {
+	if !s.MediaItemsSet {
+		return nil, ListStats{}, ErrMediaItemsNotSet
+	}
+	stats := ListStats{}
+	items, err := s.listPickerContents(ctx, &stats)
+	return items, stats, err
+}
+
+// listPickerContents lists all the session's items, updating stats
+func (s *GooglePhotosPickerSession) listPickerContents(ctx context.Context, stats *ListStats) ([]GooglePhotosPickedItem, error) {
+	photos := []GooglePhotosPickedItem{}
+	err := s.eachItem(ctx, stats, func(item GooglePhotosPickedItem) error {
+		photos = append(photos, item)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	photos := []GooglePhotosPickedItem{}
+	return DedupeItems(photos), nil
+}
+
+// GetMediaItems returns the session's items with the given IDs, in the
+// order of ids, such as to get fresh base URLs for items saved from a
+// session fetched with ResumeSession. The Picker API can't look items up
+// by ID, so the session is listed once and the items picked out of it.
+// IDs that aren't in the session are left out and returned as errors
+// wrapping ErrItemNotInSession, joined together.
+func (s *GooglePhotosPickerSession) GetMediaItems(ctx context.Context, ids []string) ([]GooglePhotosPickedItem, error) {
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	found := map[string]GooglePhotosPickedItem{}
+	err := s.EachItem(ctx, func(item GooglePhotosPickedItem) error {
+		if wanted[item.ID] {
+			found[item.ID] = item
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	items := []GooglePhotosPickedItem{}
+	var errs []error
+	for _, id := range ids {
+		item, ok := found[id]
+		if !ok {
+			errs = append(errs, fmt.Errorf("item %s: %w %s", id, ErrItemNotInSession, s.ID))
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, errors.Join(errs...)
+}
+
+// EachItem calls fn for each item picked in the session as pages of items
+// are fetched, without holding every item in memory. Listing stops and
+// returns fn's error if it returns one.
+func (s *GooglePhotosPickerSession) EachItem(ctx context.Context, fn func(GooglePhotosPickedItem) error) error {
+	return s.eachItem(ctx, &ListStats{}, fn)
+}
+
+// eachItem is EachItem, updating stats as pages are fetched
+func (s *GooglePhotosPickerSession) eachItem(ctx context.Context, stats *ListStats, fn func(GooglePhotosPickedItem) error) error {
+	start := time.Now()
+	defer func() { stats.Elapsed = time.Since(start) }()
 	nextPageToken := "start"
 	for nextPageToken != "" {
-		baseURL := "https://photospicker.googleapis.com/v1/mediaItems"
+		if err := s.Credentials.wait(ctx, limitAPI, s.PollOptions.RateLimit); err != nil {
+			return err
+		}
+		token, err := s.Credentials.TokenContext(ctx)
+		if err != nil {
+			return err
+		}
+		baseURL := s.Credentials.pickerURL("/mediaItems")
 		// Create a URL struct and add query parameters
 		u, err := url.Parse(baseURL)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		query := u.Query()
 		query.Set("sessionId", s.ID)
+		if s.PollOptions.PageSize > 0 {
+			query.Set("pageSize", strconv.Itoa(s.PollOptions.PageSize))
+		}
 		if nextPageToken != "start" && nextPageToken != "" {
 			query.Set("pageToken", nextPageToken)
 		}
 		u.RawQuery = query.Encode()
 
-		resp, err := httpRequest(token.AccessToken,
+		resp, err := s.Credentials.request(ctx, token.AccessToken,
 			"GET",
 			u.String(),
 			nil,
 		)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		defer resp.Body.Close()
-		items, _, err := httpReadResponse[GooglePhotosPickedItems](resp.Body)
+		items, err := readAPIResponse[GooglePhotosPickedItems](resp)
+		resp.Body.Close()
 		if err != nil {
-			return nil, err
+			return sessionError(resp, err)
 		}
-		resp.Body.Close()
 		if items.Error != nil {
-			return nil, items.Error
+			return sessionError(resp, apiError(resp, items.Error))
 		}
 
-		photos = append(photos, items.Items...)
+		stats.Pages++
+		stats.Items += len(items.Items)
+		s.Credentials.logger().Debug("listed picked items", "session", s.ID, "items", len(items.Items))
+		for _, item := range items.Items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
 		nextPageToken = items.NextPageToken
 	}
-	return photos, nil
+	return nil
 }
 
 // UploadToS3 writes the photos to an S3 bucket.
 //
-// S3 environment variables _must_ be set, including:
+// Unless the region and credentials are set in opts, or opts has a
+// Session, S3 environment variables _must_ be set, including:
 //
 //   - AWS_ACCESS_KEY_ID
 //   - AWS_SECRET_ACCESS_KEY
 //   - AWS_REGION
 func (c *Credentials) UploadToS3(photos []GooglePhotosPickedItem, opts S3Options) error {
-	token, err := c.Token()
+	return c.UploadToS3Context(context.Background(), photos, opts)
+}
+
+// UploadToS3Context is like UploadToS3, using ctx for the token fetch, the
+// media downloads, the S3 uploads and the photos json. Once ctx is done,
+// in-flight uploads are aborted and no pending photos are started.
+func (c *Credentials) UploadToS3Context(ctx context.Context, photos []GooglePhotosPickedItem, opts S3Options) error {
+	_, err := c.uploadToS3(ctx, photos, opts)
+	return err
+}
+
+// PickAndUpload runs the whole picking flow: it creates a picker session,
+// calls onURL with the URL for the user to pick photos at, waits for them
+// to finish, uploads the picked photos to S3 and writes the photos json,
+// then deletes the session. It returns the result for each photo, see
+// UploadToS3Detailed.
+func (c *Credentials) PickAndUpload(ctx context.Context, s3opts S3Options, onURL func(string)) ([]UploadResult, error) {
+	s, err := c.NewPickerSessionContext(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, p := range photos {
-		if err := opts.downloadAndStore(token.AccessToken, p); err != nil {
-			return err
+	// delete the session even when ctx is cancelled, so it doesn't linger
+	defer s.Delete(context.WithoutCancel(ctx))
+
+	if onURL != nil {
+		onURL(s.PickerURI)
+	}
+	photos, err := s.WaitForPick(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s3opts.PickerSession == nil {
+		s3opts.PickerSession = s
+	}
+	return c.uploadToS3(ctx, photos, s3opts)
+}
+
+// UploadStats counts what happened to the photos during an upload
+type UploadStats struct {
+	Uploaded int // photos downloaded and written to S3
+	Skipped  int // photos skipped because they were already in S3 or too small, see S3Options.SkipExisting and S3Options.MinPixels
+}
+
+// UploadToS3WithStats is like UploadToS3, and also returns how many
+// photos were uploaded and skipped.
+func (c *Credentials) UploadToS3WithStats(photos []GooglePhotosPickedItem, opts S3Options) (UploadStats, error) {
+	results, err := c.UploadToS3Detailed(photos, opts)
+	stats := UploadStats{}
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+		case r.Skipped:
+			stats.Skipped++
+		default:
+			stats.Uploaded++
+		}
+	}
+	return stats, err
+}
+
+// UploadResult is the outcome of uploading a single photo
+type UploadResult struct {
+	Item     GooglePhotosPickedItem // The photo
+	Key      string                 // s3 key the photo was written to
+	Bytes    int64                  // Number of bytes written to S3
+	SHA256   string                 // Hex SHA256 of the bytes written to S3
+	Skipped  bool                   // True if the photo wasn't uploaded because it was already in S3 or is too small
+	TooSmall bool                   // True if the photo was skipped for being smaller than S3Options.MinPixels
+	Err      error                  // Set if the photo failed to upload
+}
+
+// UploadToS3Detailed is like UploadToS3, and also returns the result for
+// each photo in the order they were uploaded, including photos that failed.
+// The error returned joins the errors of all the failed photos.
+func (c *Credentials) UploadToS3Detailed(photos []GooglePhotosPickedItem, opts S3Options) ([]UploadResult, error) {
+	return c.uploadToS3(context.Background(), photos, opts)
+}
+
+// uploadToS3 uploads the photos and then writes the photos json
+func (c *Credentials) uploadToS3(ctx context.Context, photos []GooglePhotosPickedItem, opts S3Options) ([]UploadResult, error) {
+	if _, err := c.TokenContext(ctx); err != nil {
+		return nil, err
+	}
+	if opts.PerSessionPrefix {
+		if opts.PickerSession == nil {
+			return nil, errors.New("PerSessionPrefix requires a PickerSession")
+		}
+		opts = opts.ForSession(opts.PickerSession.ID)
+	}
+	if opts.KeyTemplate != "" {
+		if _, err := opts.keyTemplate(); err != nil {
+			return nil, err
+		}
+	}
+	photos = slices.Clone(photos)
+	SortItems(photos, opts.OrderBy)
+	if opts.DryRun {
+		return opts.plan(photos), nil
+	}
+	if opts.Session == nil {
+		// the workers share one session, since creating sessions
+		// concurrently races inside the AWS SDK
+		sess, err := opts.session()
+		if err != nil {
+			return nil, err
+		}
+		opts.Session = sess
+	}
+	results, err := opts.uploadAll(ctx, c, photos)
+	if err != nil {
+		return results, err
+	}
+	manifest := make([]GooglePhotosPickedItem, 0, len(photos))
+	for i, r := range results {
+		if r.TooSmall {
+			continue // never uploaded, so it isn't in the photos json
+		}
+		// skipped photos keep the hash they were given, if any
+		if r.SHA256 != "" {
+			photos[i].SHA256 = r.SHA256
 		}
+		manifest = append(manifest, photos[i])
+	}
+	if opts.MergeManifest {
+		return results, opts.appendPhotoJSON(ctx, manifest)
+	}
+	return results, opts.setPhotoJSON(ctx, manifest)
+}
+
+// plan returns the results of a dry run: each photo with the key it
+// would be uploaded to, marked as skipped.
+func (o S3Options) plan(photos []GooglePhotosPickedItem) []UploadResult {
+	keys := o.keys(photos)
+	results := make([]UploadResult, len(photos))
+	for i, p := range photos {
+		results[i] = UploadResult{Item: p, Key: keys[i], Skipped: true}
+	}
+	return results
+}
+
+// uploadAll runs downloadAndStore for each of the photos on a pool of
+// workers, see DownloadOptions.storeAll.
+func (o S3Options) uploadAll(ctx context.Context, c *Credentials, photos []GooglePhotosPickedItem) ([]UploadResult, error) {
+	pool := poolOptions{
+		concurrency: o.Concurrency,
+		failFast:    o.FailFast,
+		onResult: func(result UploadResult, done int) {
+			if o.OnResult != nil {
+				o.OnResult(result)
+			}
+			if o.OnProgress != nil {
+				o.OnProgress(result.Item, done, len(photos), result.Err)
+			}
+		},
 	}
-	return opts.SetPhotoJSON(photos)
+	return o.storeAll(ctx, photos, o.keys(photos), pool, func(ctx context.Context, item GooglePhotosPickedItem, key string) UploadResult {
+		return o.downloadAndStore(ctx, c, item, key)
+	})
 }
 
 func (opts S3Options) SetPhotoJSON(photos []GooglePhotosPickedItem) error {
-	return SetS3Key(opts.Bucket, opts.PhotosJSONKey, photos)
+	return opts.setPhotoJSON(context.Background(), photos)
+}
+
+func (opts S3Options) setPhotoJSON(ctx context.Context, photos []GooglePhotosPickedItem) error {
+	store, err := opts.storage()
+	if err != nil {
+		return err
+	}
+	return store.PutJSON(ctx, opts.jsonKey(), photos)
 }
 
 // downloadAndStore fetches the item and overwrites whatever is already there.
 // this is on purpose in case the size of the photo, etc changes then it gets updated.
-func (o S3Options) downloadAndStore(token string, item GooglePhotosPickedItem) error {
-	photoUrl := item.Media.BaseURL
-	if o.Width != 0 {
-		photoUrl = fmt.Sprintf("%s=w%d", item.Media.BaseURL, o.Width)
+// When SkipExisting is set, items already in S3 are skipped instead.
+func (o S3Options) downloadAndStore(ctx context.Context, c *Credentials, item GooglePhotosPickedItem, key string) UploadResult {
+	ctx, cancel := o.itemContext(ctx)
+	defer cancel()
+	result := UploadResult{Item: item, Key: key}
+	store, err := o.storage()
+	if err != nil {
+		result.Err = err
+		return result
 	}
-	if o.Height != 0 {
-		photoUrl = fmt.Sprintf("%s=h%d", item.Media.BaseURL, o.Height)
+	if o.tooSmall(item) {
+		c.logger().Debug("skipped small photo", "id", item.ID, "key", key)
+		result.Skipped = true
+		result.TooSmall = true
+		return result
 	}
-	response, err := httpRequest(token,
-		"GET",
-		photoUrl,
-		nil,
-	)
+	if o.SkipExisting {
+		exists, err := store.Exists(ctx, key)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		if exists {
+			c.logger().Debug("skipped existing photo", "id", item.ID, "key", key)
+			result.Skipped = true
+			return result
+		}
+	}
+
+	media, err := c.openMedia(ctx, item, o.DownloadOptions)
 	if err != nil {
-		return err
+		result.Err = err
+		return result
 	}
-	defer response.Body.Close()
+	defer media.Close()
+
+	var body io.Reader = media
+	if o.EmbedCaptureTime && !item.Type.IsVideo() {
+		if t := createTime(item); !t.IsZero() {
+			body = withCaptureTime(body, t)
+		}
+	}
+	contentType := ""
+	if o.ContentTypeOverride != nil {
+		contentType = o.ContentTypeOverride(item)
+	}
+	if contentType == "" {
+		body, contentType = detectContentType(body, o.contentType(item), o.filename(item))
+	}
+	// hash while streaming, so large videos aren't buffered in memory
+	hash := sha256.New()
+	counter := &countingReader{r: io.TeeReader(body, hash)}
+	var metadata map[string]string
+	if o.StoreMetadata {
+		metadata = objectMetadata(item)
+	}
+	if err := store.put(ctx, key, counter, contentType, metadata); err != nil {
+		result.Err = err
+		return result
+	}
+	result.Bytes = counter.n
+	result.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	c.logger().Info("uploaded photo", "id", item.ID, "bucket", o.Bucket, "key", key, "bytes", result.Bytes)
+
+	if o.WriteSidecar {
+		result.Err = store.PutJSON(ctx, key+".json", item)
+	}
+	return result
+}
+
+// tooSmall reports whether the item should be skipped because of MinPixels
+func (o S3Options) tooSmall(item GooglePhotosPickedItem) bool {
+	if o.MinPixels <= 0 || item.Type.IsVideo() {
+		return false
+	}
+	m := item.Media.Metadata
+	if m.Width == 0 || m.Height == 0 {
+		return o.SkipUnknownSize
+	}
+	return m.Width*m.Height < o.MinPixels
+}
 
-	key := fmt.Sprintf("%s/%s", o.PhotosPrefix, item.ID)
+// keys returns the s3 key for each of the photos, in the same order.
+func (o S3Options) keys(photos []GooglePhotosPickedItem) []string {
+	key := o.key
+	if o.KeyTemplate != "" {
+		if tmpl, err := o.keyTemplate(); err == nil {
+			key = func(item GooglePhotosPickedItem) string { return o.templateKey(tmpl, item) }
+		}
+	}
+	keys := make([]string, len(photos))
+	for i, p := range photos {
+		keys[i] = key(p)
+	}
+	return keys
+}
+
+// key returns the s3 key the item is stored at. It only depends on the
+// item, so the same photo gets the same key in every run.
+func (o S3Options) key(item GooglePhotosPickedItem) string {
+	prefix := o.PhotosPrefix
+	if o.DatePrefixLayout != "" {
+		if t := createTime(item); !t.IsZero() {
+			prefix = joinKey(prefix, t.Format(o.DatePrefixLayout))
+		}
+	}
+	if o.UseFilename {
+		if name := o.sanitize(o.filename(item)); name != "" {
+			// filenames like IMG_0001.jpg repeat across runs, so the suffix
+			// is always added rather than only when a batch has a clash
+			return joinKey(prefix, withIDSuffix(name, item.ID))
+		}
+	}
+	key := joinKey(prefix, item.ID)
 	if o.AddExtension {
-		extension := filepath.Ext(item.Media.Filename)
+		extension := filepath.Ext(o.sanitize(o.filename(item)))
 		if extension != "" {
-			key = fmt.Sprintf("%s.%s", key, extension)
+			key = fmt.Sprintf("%s%s", key, extension) // Ext includes the leading dot
 		}
 	}
-	sess, err := session.NewSession()
-	if err != nil {
-		return err
-	}
-	uploader := s3manager.NewUploader(sess)
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket:      aws.String(o.Bucket),
-		Key:         aws.String(key),
-		Body:        response.Body,
-		ContentType: aws.String(item.Media.MimeType),
-	})
+	return key
+}
 
-	return err
+// request makes a google photos request using the credentials' http client,
+// retrying transient errors according to the credentials' retry policy.
+func (c *Credentials) request(ctx context.Context, token string, method string, uri string, body []byte) (*http.Response, error) {
+	return c.requestWhen(ctx, transientResponse, token, method, uri, body)
+}
+
+// requestWhen is like request, only retrying when retryable returns true
+// for the response.
+func (c *Credentials) requestWhen(ctx context.Context, retryable func(*http.Response, error) bool, token string, method string, uri string, body []byte) (*http.Response, error) {
+	return retryWhen(ctx, c.Retry, c.logger(), retryable, func() (*http.Response, error) {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		response, err := c.httpRequest(ctx, token, method, uri, reader)
+		logResponse(c.logger(), method, uri, response, err)
+		return response, err
+	})
 }
 
 // httpRequest makes a standard google photos request
-func httpRequest(token string, method string, uri string, body io.Reader) (*http.Response, error) {
-	request, err := http.NewRequest(method, uri, body)
+func (c *Credentials) httpRequest(ctx context.Context, token string, method string, uri string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, uri, body)
 	if err != nil {
 		return nil, err
 	}
+	c.setHeaders(request)
 	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	client := &http.Client{}
-	return client.Do(request)
+	return c.do(request)
+}
+
+// readAPIResponse reads and parses the body of a Google Photos API
+// response. Unsuccessful responses are returned as an error, even when
+// their body isn't json, see responseError.
+func readAPIResponse[T any](response *http.Response) (*T, error) {
+	resp, data, err := httpReadResponse[T](response.Body)
+	if successStatus(response.StatusCode) {
+		return resp, err
+	}
+	if data == nil && err != nil {
+		return nil, err
+	}
+	return nil, responseError(response, data)
 }
 
 // httpReadResponse reads the response body and parses it,
@@ -312,7 +1036,7 @@ func httpReadResponse[T any](body io.ReadCloser) (*T, []byte, error) {
 
 	var resp T
 	if err := json.Unmarshal(data, &resp); err != nil {
-		return nil, data, err
+		return nil, data, &ParseError{Body: data, Err: err}
 	}
 	return &resp, data, nil
 }
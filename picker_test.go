@@ -0,0 +1,320 @@
+package gphotos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pickedItem returns a picked item with the id and filename
+func pickedItem(id, filename string) GooglePhotosPickedItem {
+	return GooglePhotosPickedItem{
+		ID:    id,
+		Type:  TypePhoto,
+		Media: GooglePhotosPickedMedia{Filename: filename, MimeType: "image/jpeg"},
+	}
+}
+
+func TestFilenameKeysAreStableAcrossRuns(t *testing.T) {
+	opts := NewS3Options("bucket")
+	opts.UseFilename = true
+	first := pickedItem("AF1QipFirst", "IMG_0001.jpg")
+	second := pickedItem("AF1QipSecond", "IMG_0001.jpg")
+
+	// each run picked a different IMG_0001.jpg
+	run1 := opts.keys([]GooglePhotosPickedItem{first})
+	run2 := opts.keys([]GooglePhotosPickedItem{second})
+	if run1[0] == run2[0] {
+		t.Errorf("different photos got the same key %s", run1[0])
+	}
+	// the same photo picked alone and with a clashing photo
+	both := opts.keys([]GooglePhotosPickedItem{first, second})
+	if both[0] != run1[0] || both[1] != run2[0] {
+		t.Errorf("keys changed with the batch: %v and %v, then %v", run1, run2, both)
+	}
+	if !strings.HasPrefix(run1[0], "photos/IMG_0001-") || !strings.HasSuffix(run1[0], ".jpg") {
+		t.Errorf("key %s isn't the filename with a suffix", run1[0])
+	}
+}
+
+// pollingSession returns a session polled at the handler, with a short
+// poll interval
+func pollingSession(t *testing.T, handler http.HandlerFunc) *GooglePhotosPickerSession {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	c := tokenCredentials()
+	c.PickerBaseURL = server.URL
+	return &GooglePhotosPickerSession{
+		ID:          "session",
+		PollingURI:  server.URL + "/sessions/session",
+		ExpireTime:  time.Now().Add(time.Hour),
+		Credentials: c,
+		PollOptions: PollOptions{MinPollInterval: time.Millisecond},
+	}
+}
+
+func TestPollSessionNotFound(t *testing.T) {
+	s := pollingSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND"}}`))
+	})
+
+	_, err := s.Poll(context.Background())
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("got error %v, want ErrSessionNotFound", err)
+	}
+	var apiErr *GooglePhotosError
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+		t.Errorf("error %v doesn't wrap the API error", err)
+	}
+}
+
+func TestPollTimeout(t *testing.T) {
+	s := pollingSession(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"session","mediaItemsSet":false}`))
+	})
+	s.PollOptions.MaxPollDuration = 20 * time.Millisecond
+
+	start := time.Now()
+	_, err := s.Poll(context.Background())
+	if !errors.Is(err, ErrPollTimeout) {
+		t.Fatalf("got error %v, want ErrPollTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Poll took %s, want about the MaxPollDuration", elapsed)
+	}
+}
+
+func TestPollIntervalClampedToMinimum(t *testing.T) {
+	s := &GooglePhotosPickerSession{PollOptions: PollOptions{MinPollInterval: 3 * time.Second}}
+	if got := s.pollInterval(); got != 3*time.Second {
+		t.Errorf("zero interval polled every %s, want the 3s minimum", got)
+	}
+	s.PollOptions.MinPollInterval = 0
+	if got := s.pollInterval(); got != 2*time.Second {
+		t.Errorf("zero interval polled every %s, want the 2s default minimum", got)
+	}
+	s.PollingConfig.PollInterval = Duration(5 * time.Second)
+	if got := s.pollInterval(); got != 5*time.Second {
+		t.Errorf("polled every %s, want Google's 5s interval", got)
+	}
+}
+
+func TestKeyAddExtension(t *testing.T) {
+	opts := NewS3Options("bucket")
+	opts.AddExtension = true
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"IMG_0001.jpg", "photos/abc.jpg"},
+		{"photo.final.HEIC", "photos/abc.HEIC"},
+		{"no-extension", "photos/abc"},
+		{"", "photos/abc"},
+	}
+	for _, tt := range tests {
+		if got := opts.key(pickedItem("abc", tt.filename)); got != tt.want {
+			t.Errorf("key for %q = %s, want %s", tt.filename, got, tt.want)
+		}
+	}
+}
+
+// a mediaItems.list response captured from the Picker API
+const mediaItemsPayload = `{
+  "mediaItems": [
+    {
+      "id": "AF1QipM3example",
+      "createTime": "2024-06-01T12:34:56Z",
+      "type": "PHOTO",
+      "mediaFile": {
+        "baseUrl": "https://lh3.googleusercontent.com/ppa/example",
+        "mimeType": "image/jpeg",
+        "filename": "IMG_0001.jpg",
+        "mediaFileMetadata": {
+          "width": 4032,
+          "height": 3024,
+          "cameraMake": "Apple",
+          "cameraModel": "iPhone 15",
+          "photoMetadata": {
+            "focalLength": 6.86,
+            "apertureFNumber": 1.78,
+            "isoEquivalent": 50,
+            "exposureTime": "0.008s"
+          }
+        }
+      }
+    },
+    {
+      "id": "AF1QipVideo",
+      "createTime": "2024-06-02T08:00:00Z",
+      "type": "VIDEO",
+      "mediaFile": {
+        "baseUrl": "https://lh3.googleusercontent.com/ppa/video",
+        "mimeType": "video/mp4",
+        "filename": "VID_0002.mp4",
+        "mediaFileMetadata": {
+          "width": 1920,
+          "height": 1080,
+          "videoMetadata": {"fps": 29.97, "processingStatus": "READY"}
+        }
+      }
+    }
+  ],
+  "nextPageToken": "next"
+}`
+
+// a sessions.get response captured from the Picker API
+const sessionPayload = `{
+  "id": "session-id",
+  "pickerUri": "https://photos.google.com/picker/session-id",
+  "pollingConfig": {"pollInterval": "5s", "timeoutIn": "1799s"},
+  "expireTime": "2024-06-01T13:04:56.123Z",
+  "pickingConfig": {"maxItemCount": "50"},
+  "mediaItemsSet": true
+}`
+
+func TestPickerPayloadRoundTrip(t *testing.T) {
+	var items GooglePhotosPickedItems
+	if err := json.Unmarshal([]byte(mediaItemsPayload), &items); err != nil {
+		t.Fatal(err)
+	}
+	photo, video := items.Items[0], items.Items[1]
+	m := photo.Media.Metadata
+	if photo.ID != "AF1QipM3example" || photo.Type != TypePhoto || photo.Media.Filename != "IMG_0001.jpg" ||
+		m.Width != 4032 || m.CameraModel != "iPhone 15" || m.PhotoMetadata == nil || m.PhotoMetadata.IsoEquivalent != 50 {
+		t.Errorf("photo parsed as %+v", photo)
+	}
+	if video.Type != TypeVideo || video.Media.Metadata.VideoMetadata == nil || video.Media.Metadata.VideoMetadata.ProcessingStatus != "READY" {
+		t.Errorf("video parsed as %+v", video)
+	}
+	if items.NextPageToken != "next" {
+		t.Errorf("next page token parsed as %q", items.NextPageToken)
+	}
+	assertRoundTrip(t, &items)
+
+	var session GooglePhotosPickerSession
+	if err := json.Unmarshal([]byte(sessionPayload), &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.ID != "session-id" || !session.MediaItemsSet || time.Duration(session.PollingConfig.PollInterval) != 5*time.Second ||
+		session.PickingConfig == nil || session.PickingConfig.MaxItemCount != 50 || session.ExpireTime.IsZero() {
+		t.Errorf("session parsed as %+v", &session)
+	}
+	assertRoundTrip(t, &session)
+}
+
+// assertRoundTrip checks that v is unchanged after marshaling it to json
+// and back
+func assertRoundTrip[T any](t *testing.T, v *T) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back T
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, &back) {
+		t.Errorf("round trip changed %T:\n%s", v, data)
+	}
+}
+
+func TestCreateSessionsCancelsInFlight(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // doesn't answer until the test is done
+	}))
+	defer server.Close()
+	defer close(release)
+	c := tokenCredentials()
+	c.PickerBaseURL = server.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, errs := CreateSessions(ctx, []*Credentials{c, c}, 2)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("CreateSessions took %s after ctx was done", elapsed)
+	}
+	for i, err := range errs {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("session %d got error %v, want the ctx error", i, err)
+		}
+	}
+}
+
+func TestCreateSessionsRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"session"}`))
+	}))
+	defer server.Close()
+	creds := make([]*Credentials, 4)
+	for i := range creds {
+		creds[i] = tokenCredentials()
+		creds[i].PickerBaseURL = server.URL
+	}
+
+	start := time.Now()
+	sessions, errs := CreateSessionsWithOptions(context.Background(), creds, CreateSessionsOptions{Concurrency: 4, RateLimit: 20})
+	// the first request starts right away, then one every 50ms
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("created 4 sessions in %s, want the requests spread out", elapsed)
+	}
+	for i := range sessions {
+		if errs[i] != nil || sessions[i] == nil {
+			t.Errorf("session %d: %v", i, errs[i])
+		}
+	}
+}
+
+func TestKeyTemplate(t *testing.T) {
+	item := pickedItem("AF1QipFirst", "IMG_0001.jpg")
+	item.CreateTime = "2024-06-01T12:34:56Z"
+	item.Media.Metadata.CameraMake = "Apple"
+	suffixed := withIDSuffix("IMG_0001.jpg", item.ID)
+	tests := []struct {
+		name     string
+		template string
+		item     GooglePhotosPickedItem
+		want     string
+	}{
+		{"fields", "{{.Prefix}}/{{.Year}}/{{.Month}}/{{.CameraMake}}/{{.Filename}}", item, "photos/2024/06/Apple/" + suffixed},
+		{"id in the key", "{{.Prefix}}/{{.ID}}{{.Ext}}", item, "photos/AF1QipFirst.jpg"},
+		{"no create time", "{{.Year}}/{{.ID}}", pickedItem("abc", "a.jpg"), "unknown/abc"},
+		{"separators in values", "{{.Prefix}}/{{.Filename}}", pickedItem("abc", "../a/b\x00.jpg"), "photos/" + withIDSuffix("_._a_b_.jpg", "abc")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := NewS3Options("bucket")
+			opts.KeyTemplate = tt.template
+			if got := opts.keys([]GooglePhotosPickedItem{tt.item})[0]; got != tt.want {
+				t.Errorf("key = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyTemplateStableAcrossRuns(t *testing.T) {
+	opts := NewS3Options("bucket")
+	opts.KeyTemplate = "{{.Prefix}}/{{.Filename}}"
+	first := pickedItem("AF1QipFirst", "IMG_0001.jpg")
+	second := pickedItem("AF1QipSecond", "IMG_0001.jpg")
+
+	run1 := opts.keys([]GooglePhotosPickedItem{first})
+	run2 := opts.keys([]GooglePhotosPickedItem{second})
+	if run1[0] == run2[0] {
+		t.Errorf("different photos got the same key %s", run1[0])
+	}
+	both := opts.keys([]GooglePhotosPickedItem{first, second})
+	if both[0] != run1[0] || both[1] != run2[0] {
+		t.Errorf("keys changed with the batch: %v and %v, then %v", run1, run2, both)
+	}
+}
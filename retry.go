@@ -0,0 +1,115 @@
+package gphotos
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how requests to Google are retried after
+// transient errors: HTTP 429, 500, 502 and 503 responses. Token refreshes
+// are also retried after network errors and any 5xx response, but never
+// after another 4xx. A Retry-After header on the response takes precedence
+// over the computed backoff, unless it asks to wait longer than MaxDelay,
+// in which case the response is returned without retrying. Creating a
+// picker session isn't idempotent, so it is only retried after HTTP 429.
+type RetryPolicy struct {
+	MaxAttempts int           // Attempts per request including the first, defaults to 4. Set to 1 to fail fast
+	BaseDelay   time.Duration // Delay before the first retry, doubling for each retry after that. Defaults to 500ms
+	MaxDelay    time.Duration // Longest delay between attempts, defaults to 30s
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 4
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 500 * time.Millisecond
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 30 * time.Second
+	}
+	return p
+}
+
+// backoff returns the delay before the given retry, starting at 1.
+// The delay is jittered between half and all of the exponential delay.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseDelay << (retry - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retryableStatus reports whether a response status is worth retrying
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// tokenRetryable reports whether a token request is worth retrying:
+// network errors and 5xx responses. 4xx responses such as invalid_grant
+// are permanent, so they are never retried.
+func tokenRetryable(response *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return response.StatusCode >= 500
+}
+
+// transientResponse reports whether a request is worth retrying:
+// responses with a status from retryableStatus.
+func transientResponse(response *http.Response, err error) bool {
+	return err == nil && retryableStatus(response.StatusCode)
+}
+
+// rateLimited reports whether a request was rejected by rate limiting
+// before it was handled, so it is safe to retry even when it isn't
+// idempotent.
+func rateLimited(response *http.Response, err error) bool {
+	return err == nil && response.StatusCode == http.StatusTooManyRequests
+}
+
+// retryWhen calls do until retryable returns false for its result or the
+// policy's attempts are used up. The last response is returned as-is, so
+// callers handle errors the same way as without retries.
+func retryWhen(ctx context.Context, policy RetryPolicy, log *slog.Logger, retryable func(*http.Response, error) bool, do func() (*http.Response, error)) (*http.Response, error) {
+	policy = policy.withDefaults()
+	for attempt := 1; ; attempt++ {
+		response, err := do()
+		if attempt >= policy.MaxAttempts || ctx.Err() != nil || !retryable(response, err) {
+			return response, err
+		}
+		delay := policy.backoff(attempt)
+		if response != nil {
+			if at, ok := retryAfter(response.Header); ok {
+				delay = max(time.Until(at), 0)
+				if delay > policy.MaxDelay {
+					// waiting would block for longer than the policy allows
+					return response, err
+				}
+			}
+			response.Body.Close()
+			log.Debug("retrying request", "attempt", attempt, "delay", delay, "status", response.StatusCode)
+		} else {
+			log.Debug("retrying request", "attempt", attempt, "delay", delay, "error", err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package gphotos
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fastRetry retries quickly so tests don't wait on the default backoff
+var fastRetry = RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+func TestTokenRetriesServerErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"access_token":"fresh","expires_in":3600}`))
+	}))
+	defer server.Close()
+	c := &Credentials{RefreshToken: "refresh", TokenURL: server.URL, Retry: fastRetry}
+
+	token, err := c.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if token.AccessToken != "fresh" || requests.Load() != 3 {
+		t.Errorf("got token %q after %d requests, want a token after 3", token.AccessToken, requests.Load())
+	}
+}
+
+func TestTokenDoesNotRetryInvalidGrant(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`))
+	}))
+	defer server.Close()
+	c := &Credentials{RefreshToken: "refresh", TokenURL: server.URL, Retry: fastRetry}
+
+	_, err := c.Token()
+	if !errors.Is(err, ErrRefreshTokenRevoked) {
+		t.Errorf("got error %v, want ErrRefreshTokenRevoked", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestRetryAfterBeyondMaxDelay(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"code":429,"message":"Quota exceeded","status":"RESOURCE_EXHAUSTED"}}`))
+	}))
+	defer server.Close()
+	c := tokenCredentials()
+	c.PickerBaseURL = server.URL
+
+	start := time.Now()
+	_, err := c.ResumeSession(context.Background(), "session")
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) {
+		t.Fatalf("got error %v, want a QuotaError", err)
+	}
+	if n := requests.Load(); n != 1 || time.Since(start) > time.Second {
+		t.Errorf("got %d requests in %s, want 1 without waiting an hour", n, time.Since(start))
+	}
+}
+
+func TestCreateSessionRetriesOnlyRateLimits(t *testing.T) {
+	for status, want := range map[int]int32{
+		http.StatusServiceUnavailable: 1,
+		http.StatusTooManyRequests:    2,
+	} {
+		var requests atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) == 1 {
+				http.Error(w, "try again", status)
+				return
+			}
+			w.Write([]byte(`{"id":"session"}`))
+		}))
+		c := tokenCredentials()
+		c.PickerBaseURL = server.URL
+
+		c.NewPickerSessionContext(context.Background())
+		if n := requests.Load(); n != want {
+			t.Errorf("after a %d, got %d requests, want %d", status, n, want)
+		}
+		server.Close()
+	}
+}
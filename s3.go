@@ -2,24 +2,163 @@ package gphotos
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 // S3Options provide configuration over where photos should be stored in S3
 type S3Options struct {
+	DownloadOptions // how media is requested from Google Photos, such as Width and Height
+
 	Bucket        string // Required. s3 bucket to upload content.
 	PhotosJSONKey string // s3 key for a json dump of all the photos info, default to `photos.json`
-	PhotosPrefix  string // s3 key prefix for where to put the photos without the trailing slash, defaults to `photos`
-	Width         int    // width of the image to request from Google Photos. If not provided, gets full width
-	Height        int    // height of the image to request from Google Photos. If not provided, gets full height
+	PhotosPrefix  string // s3 key prefix for where to put the photos, with or without a trailing slash. Defaults to `photos`
 	AddExtension  bool   // add the extension of the file onto the s3 key. Defaults to false, uploading by Google Photos ID
+
+	// UseFilename stores photos under their original filename instead of
+	// their Google Photos ID. Filenames may contain slashes, so they're
+	// cleaned up with SanitizeFilename first. Filenames such as
+	// `IMG_0001.jpg` repeat as camera counters wrap, so every key gets a
+	// short suffix derived from the photo's ID, such as
+	// `IMG_0001-3f9a1c2e.jpg`. The same photo always gets the same key, and
+	// different photos are very unlikely to share one. AddExtension is
+	// ignored when set.
+	UseFilename bool
+
+	// SanitizeFilename makes a photo's filename safe to use in its key when
+	// UseFilename, AddExtension or the Filename and Ext of KeyTemplate are
+	// used. Defaults to replacing path separators and control characters
+	// with `_`, collapsing whitespace and replacing a leading dot.
+	SanitizeFilename func(name string) string
+
+	// DatePrefixLayout is a Go time layout, such as `2006/01`, used to put
+	// photos under a folder for their create time between PhotosPrefix and
+	// the photo, like `photos/2024/06/<id>`. Photos without a create time
+	// stay directly under PhotosPrefix. Defaults to no date folders.
+	DatePrefixLayout string
+
+	// KeyTemplate is a text/template for the key of each photo, such as
+	// `{{.Prefix}}/{{.Year}}/{{.CameraMake}}/{{.Filename}}`, with the fields
+	// of KeyData. Path separators and control characters in the values are
+	// replaced with `_`. Unless the key includes `{{.ID}}`, a short suffix
+	// from the ID is always added, like `IMG_0001-3f9a1c2e.jpg`, so photos
+	// with the same filename don't overwrite each other across runs.
+	// UseFilename, AddExtension and DatePrefixLayout are ignored when set.
+	// Defaults to the PhotosPrefix and ID scheme.
+	KeyTemplate string
+
+	OrderBy      OrderBy // order to upload the photos in, defaults to the order they were picked
+	WriteSidecar bool    // write a `<key>.json` sidecar with the item's metadata next to each photo. Defaults to false
+	Concurrency  int     // number of photos to download and upload at once, defaults to 4
+	FailFast     bool    // stop at the first failed photo instead of attempting all of them and returning every error
+	SkipExisting bool    // skip photos whose key already exists in S3 instead of overwriting them. Defaults to false
+
+	// MinPixels skips photos whose width times height from Google is less
+	// than it, such as small screenshots. They are reported as skipped
+	// and TooSmall, and left out of the photos json. Photos that report no
+	// dimensions are uploaded unless SkipUnknownSize is set. Videos are
+	// always uploaded. Defaults to 0, uploading every photo.
+	MinPixels       int
+	SkipUnknownSize bool
+
+	// DryRun computes the key for each photo without downloading or
+	// uploading anything or writing the photos json. UploadToS3Detailed
+	// returns the planned keys as skipped results. Defaults to false.
+	DryRun bool
+
+	// StoreMetadata sets S3 user metadata on each photo from its Google
+	// Photos fields, such as `x-amz-meta-camera-make` and
+	// `x-amz-meta-create-time`, see objectMetadata. Defaults to false.
+	StoreMetadata bool
+
+	// ContentTypeOverride returns the content type to store each photo
+	// with. When nil or it returns "", the MimeType from Google is used,
+	// falling back to the type for the filename's extension or sniffed
+	// from the content when it's missing or `application/octet-stream`.
+	ContentTypeOverride func(item GooglePhotosPickedItem) string
+
+	// OnProgress is called after each photo is uploaded, skipped or fails,
+	// with the number of photos done so far out of the total. err is set
+	// if the photo failed. Calls are never made concurrently.
+	OnProgress func(item GooglePhotosPickedItem, done, total int, err error)
+
+	// OnResult is called with the result of each photo as it's uploaded,
+	// skipped or fails, right before OnProgress, such as to count the
+	// bytes uploaded. Calls are never made concurrently.
+	OnResult func(result UploadResult)
+
+	// EmbedCaptureTime writes the item's create time into the EXIF
+	// DateTimeOriginal of downloaded JPEGs that have no EXIF data.
+	// Other formats are uploaded as-is. Defaults to false.
+	EmbedCaptureTime bool
+
+	// BackupCorruptManifest copies an unparseable photos json file to
+	// `<PhotosJSONKey>.corrupt.<unix timestamp>` and starts over with an
+	// empty manifest instead of returning the error. Defaults to false.
+	BackupCorruptManifest bool
+
+	// PerSessionPrefix puts the photos and the photos json of each upload
+	// under a folder for its picker session, like `photos/<session id>/`,
+	// see ForSession, so batches don't overwrite each other and can be
+	// deleted together. DownloadOptions.PickerSession must be set, which
+	// PickAndUpload does. Defaults to false.
+	PerSessionPrefix bool
+
+	// MergeManifest merges the uploaded photos into the existing photos
+	// json file instead of overwriting it, see AppendPhotoJSON, so that
+	// photos from earlier runs stay listed. Defaults to false.
+	MergeManifest bool
+
+	// Session is used for all S3 requests when set, instead of creating a
+	// session from the environment. Endpoint, ForcePathStyle, Region and
+	// the AWS credentials are ignored.
+	Session *session.Session
+	// Region is the AWS region of the bucket, defaults to AWS_REGION
+	Region string
+	// AccessKeyID and SecretAccessKey are the AWS credentials to upload
+	// with, along with SessionToken for temporary credentials. Defaults to
+	// the AWS environment variables and default credential chain
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Endpoint overrides the S3 endpoint, such as for MinIO or LocalStack
+	Endpoint string
+	// ForcePathStyle uses `endpoint/bucket/key` style URLs, which most
+	// S3-compatible object stores require
+	ForcePathStyle bool
+
+	StorageClass string // storage class for photos, such as `STANDARD_IA` or `GLACIER`. The photos json and sidecars always use the bucket's default, so later runs can read them. Defaults to the bucket's default
+	SSE          string // server-side encryption, `AES256` or `aws:kms`. Defaults to the bucket's default
+	SSEKMSKeyID  string // KMS key to encrypt with when SSE is `aws:kms`. Defaults to the AWS managed key
+
+	// PartSize is the size of each part when large photos and videos are
+	// uploaded in parts. S3's minimum is 5 MiB, and smaller sizes are
+	// raised to it. Parts are retried by the AWS session's retryer, and a
+	// failed upload is aborted so no orphaned parts are left. Defaults to 5 MiB.
+	PartSize int64
+	// UploadConcurrency is the number of parts of a single photo uploaded
+	// at once, on top of Concurrency photos at once. Defaults to 5
+	UploadConcurrency int
 }
 
 // NewS3Options creates a new S3Options object with defaults
@@ -31,57 +170,513 @@ func NewS3Options(bucket string) S3Options {
 	}
 }
 
+// ForSession returns a copy of o with the photos and the photos json
+// placed under a folder for the session, such as
+// `photos/<sessionID>/photos.json`.
+func (o S3Options) ForSession(sessionID string) S3Options {
+	o.PhotosPrefix = path.Join(o.PhotosPrefix, sessionID)
+	o.PhotosJSONKey = path.Join(o.PhotosPrefix, path.Base(o.PhotosJSONKey))
+	return o
+}
+
 func S3Key[T any](bucket string, filename string) ([]T, error) {
-	photos := []T{}
 	sess, err := session.NewSession()
 	if err != nil {
 		return nil, err
 	}
+	photos, _, err := s3Key[T](context.Background(), sess, bucket, filename)
+	return photos, err
+}
+
+// s3Key reads and parses the json at the s3 key using the session,
+// also returning the object's ETag
+func s3Key[T any](ctx context.Context, sess *session.Session, bucket string, filename string) ([]T, string, error) {
+	photos := []T{}
 	svc := s3.New(sess)
-	obj, err := svc.GetObject(&s3.GetObjectInput{
+	obj, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(filename),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("error fetching %s from %s: %w", filename, bucket, err)
+		return nil, "", fmt.Errorf("error fetching %s from %s: %w", filename, bucket, err)
 	}
 	defer obj.Body.Close()
+	etag := aws.StringValue(obj.ETag)
 	buf, err := io.ReadAll(obj.Body)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	err = json.Unmarshal(buf, &photos)
-	if err != nil {
-		fmt.Printf("error unmarshaling photos cache file:\n%s\nerror: %v", string(buf), err)
-		return nil, err
+	// parse each entry on its own, so one bad entry doesn't lose the rest
+	var entries []json.RawMessage
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		// the etag lets callers overwrite the corrupt file conditionally
+		return nil, etag, fmt.Errorf("error parsing %s from %s: %w", filename, bucket, err)
+	}
+	partialErr := &PartialManifestError{Key: filename}
+	for i, entry := range entries {
+		var photo T
+		if err := json.Unmarshal(entry, &photo); err != nil {
+			partialErr.Entries = append(partialErr.Entries, i)
+			partialErr.Errs = append(partialErr.Errs, err)
+			continue
+		}
+		photos = append(photos, photo)
 	}
-	return photos, nil
+	if len(partialErr.Entries) > 0 {
+		return photos, etag, partialErr
+	}
+	return photos, etag, nil
+}
+
+// PartialManifestError is returned along with the entries that could be
+// read when some entries of a json manifest can't be parsed, such as after
+// a schema change. Use errors.As to check for it and keep the entries.
+type PartialManifestError struct {
+	Key     string  // s3 key of the manifest
+	Entries []int   // indexes of the entries that couldn't be parsed
+	Errs    []error // the parse error of each entry in Entries
+}
+
+func (e *PartialManifestError) Error() string {
+	return fmt.Sprintf("skipped %d unparseable entries of %s, first at index %d: %v", len(e.Entries), e.Key, e.Entries[0], e.Errs[0])
 }
 
 func SetS3Key[T any](bucket string, filename string, photos []T) error {
-	buf, err := json.Marshal(photos)
+	return S3Storage{Bucket: bucket}.PutJSON(context.Background(), filename, photos)
+}
+
+// session returns the configured AWS session, or creates a new one
+func (o S3Options) session() (*session.Session, error) {
+	if o.Session != nil {
+		return o.Session, nil
+	}
+	config := aws.NewConfig()
+	if o.Endpoint != "" {
+		config = config.WithEndpoint(o.Endpoint)
+	}
+	if o.ForcePathStyle {
+		config = config.WithS3ForcePathStyle(true)
+	}
+	if o.Region != "" {
+		config = config.WithRegion(o.Region)
+	}
+	if o.AccessKeyID != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(o.AccessKeyID, o.SecretAccessKey, o.SessionToken))
+	}
+	return session.NewSession(config)
+}
+
+// storage returns the S3Storage that photos are written to
+func (o S3Options) storage() (S3Storage, error) {
+	sess, err := o.session()
 	if err != nil {
+		return S3Storage{}, err
+	}
+	return S3Storage{
+		Bucket:       o.Bucket,
+		Session:      sess,
+		StorageClass: o.StorageClass,
+		SSE:          o.SSE,
+		SSEKMSKeyID:  o.SSEKMSKeyID,
+
+		PartSize:          o.PartSize,
+		UploadConcurrency: o.UploadConcurrency,
+	}, nil
+}
+
+// Validate checks that the bucket exists and can be written to with the
+// configured session and credentials, by writing and then deleting a small
+// `.gphotos-preflight` object under PhotosPrefix. Call it before a batch of
+// uploads to fail early with a clear error, instead of failing every photo.
+// Upload-only credentials are enough: checking the bucket needs
+// s3:ListBucket, so a denied check is ignored and the write decides. When
+// deleting isn't allowed either, the preflight object is left in the
+// bucket, and overwritten by the next Validate.
+func (o S3Options) Validate(ctx context.Context) error {
+	if o.Bucket == "" {
+		return errors.New("no s3 bucket set")
+	}
+	if o.KeyTemplate != "" {
+		if _, err := o.keyTemplate(); err != nil {
+			return err
+		}
+	}
+	if err := o.DownloadOptions.Validate(); err != nil {
 		return err
 	}
-	sess, err := session.NewSession()
+	sess, err := o.session()
 	if err != nil {
 		return err
 	}
-	uploader := s3manager.NewUploader(sess)
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket:      aws.String(bucket),
-		Key:         aws.String(filename),
-		Body:        bytes.NewBuffer(buf),
-		ContentType: aws.String("application/json"),
-	})
+	svc := s3.New(sess)
+	_, err = svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(o.Bucket)})
+	var awsErr awserr.RequestFailure
+	if errors.As(err, &awsErr) {
+		switch awsErr.StatusCode() {
+		case http.StatusNotFound:
+			return fmt.Errorf("s3 bucket %s doesn't exist: %w", o.Bucket, err)
+		case http.StatusForbidden:
+			// no s3:ListBucket permission, the write below still checks access
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error checking s3 bucket %s: %w", o.Bucket, err)
+	}
 
+	store, err := o.storage()
 	if err != nil {
 		return err
 	}
+	key := joinKey(o.PhotosPrefix, ".gphotos-preflight")
+	if err := store.Put(ctx, key, strings.NewReader("ok"), "text/plain"); err != nil {
+		return fmt.Errorf("unable to write to s3 bucket %s, check s3:PutObject permission: %w", o.Bucket, err)
+	}
+	// deleting may not be allowed for upload-only credentials, which is fine
+	svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(o.Bucket),
+		Key:    aws.String(key),
+	})
 	return nil
 }
 
-// PhotoJSON returns the photos metadata json file stored in S3
+// PhotoJSON returns the photos metadata json file stored in S3.
+// If some entries can't be parsed, the others are returned along with a
+// *PartialManifestError.
 func (o S3Options) PhotoJSON() ([]GooglePhotosPickedItem, error) {
-	return S3Key[GooglePhotosPickedItem](o.Bucket, o.PhotosJSONKey)
+	photos, _, err := o.photoJSON(context.Background())
+	return photos, err
+}
+
+// PhotoJSONWithETag is like PhotoJSON, and also returns the ETag of the
+// photos json file to pass to SetPhotoJSONIfUnchanged. If a corrupt file
+// was backed up, see BackupCorruptManifest, no photos are returned along
+// with the corrupt file's ETag, so it can be replaced.
+func (o S3Options) PhotoJSONWithETag(ctx context.Context) ([]GooglePhotosPickedItem, string, error) {
+	return o.photoJSON(ctx)
+}
+
+func (o S3Options) photoJSON(ctx context.Context) ([]GooglePhotosPickedItem, string, error) {
+	sess, err := o.session()
+	if err != nil {
+		return nil, "", err
+	}
+	photos, etag, err := s3Key[GooglePhotosPickedItem](ctx, sess, o.Bucket, o.jsonKey())
+	if err != nil && o.BackupCorruptManifest && isCorruptJSON(err) {
+		if err := o.backupCorruptManifest(ctx); err != nil {
+			return nil, "", err
+		}
+		// the corrupt file is still at the key, so its etag is needed to
+		// replace it with SetPhotoJSONIfUnchanged
+		return []GooglePhotosPickedItem{}, etag, nil
+	}
+	return photos, etag, err
+}
+
+// ErrManifestChanged is returned by SetPhotoJSONIfUnchanged when the photos
+// json file was changed since it was read, such as by another worker.
+var ErrManifestChanged = errors.New("the photos json file changed since it was read")
+
+// SetPhotoJSONIfUnchanged writes the photos json file only if it still has
+// the etag from PhotoJSONWithETag, returning the new ETag. An empty etag
+// only writes the file if it doesn't exist yet. If the file was changed in
+// the meantime, ErrManifestChanged is returned, and the caller should read
+// it again, merge and retry. The bucket must support conditional writes.
+func (o S3Options) SetPhotoJSONIfUnchanged(ctx context.Context, etag string, photos []GooglePhotosPickedItem) (string, error) {
+	store, err := o.storage()
+	if err != nil {
+		return "", err
+	}
+	sess, err := store.session()
+	if err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(photos)
+	if err != nil {
+		return "", err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(o.Bucket),
+		Key:         aws.String(o.jsonKey()),
+		Body:        bytes.NewReader(buf),
+		ContentType: aws.String("application/json"),
+	}
+	// like PutJSON, the photos json keeps the bucket's default storage class
+	if store.SSE != "" {
+		input.ServerSideEncryption = aws.String(store.SSE)
+	}
+	if store.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(store.SSEKMSKeyID)
+	}
+	// the SDK's PutObjectInput has no precondition fields, so set the headers
+	precondition := map[string]string{"If-Match": etag}
+	if etag == "" {
+		precondition = map[string]string{"If-None-Match": "*"}
+	}
+	out, err := s3.New(sess).PutObjectWithContext(ctx, input, request.WithSetRequestHeaders(precondition))
+	var awsErr awserr.RequestFailure
+	// S3 returns a 409 when a conditional write races with another write
+	if errors.As(err, &awsErr) && (awsErr.StatusCode() == http.StatusPreconditionFailed || awsErr.StatusCode() == http.StatusConflict) {
+		return "", ErrManifestChanged
+	}
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+// AppendPhotoJSON merges photos into the photos json file stored in S3.
+// Photos already in the file are replaced by the new photo with the same ID,
+// keeping their position, and new photos are added at the end. The file is
+// created if it doesn't exist yet. A file with entries that can't be parsed
+// is left as-is and the *PartialManifestError is returned, so no entries
+// are lost.
+func (o S3Options) AppendPhotoJSON(photos []GooglePhotosPickedItem) error {
+	return o.appendPhotoJSON(context.Background(), photos)
+}
+
+func (o S3Options) appendPhotoJSON(ctx context.Context, photos []GooglePhotosPickedItem) error {
+	existing, _, err := o.photoJSON(ctx)
+	if isNoSuchKey(err) {
+		existing, err = []GooglePhotosPickedItem{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	index := map[string]int{}
+	for i, p := range existing {
+		index[p.ID] = i
+	}
+	for _, p := range photos {
+		if i, ok := index[p.ID]; ok {
+			if p.SHA256 == "" {
+				// skipped photos weren't hashed, so keep the earlier hash
+				p.SHA256 = existing[i].SHA256
+			}
+			existing[i] = p
+			continue
+		}
+		index[p.ID] = len(existing)
+		existing = append(existing, p)
+	}
+	return o.setPhotoJSON(ctx, existing)
+}
+
+// NewItems returns the picked items that aren't in the photos json file
+// yet, keeping their order, for syncing only new photos. All the items
+// are returned if there's no photos json file yet.
+func (o S3Options) NewItems(ctx context.Context, picked []GooglePhotosPickedItem) ([]GooglePhotosPickedItem, error) {
+	existing, _, err := o.photoJSON(ctx)
+	if isNoSuchKey(err) {
+		return picked, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	synced := map[string]bool{}
+	for _, p := range existing {
+		synced[p.ID] = true
+	}
+	items := []GooglePhotosPickedItem{}
+	for _, p := range picked {
+		if !synced[p.ID] {
+			items = append(items, p)
+		}
+	}
+	return items, nil
+}
+
+// isNoSuchKey reports whether err is from reading an s3 key that doesn't exist
+func isNoSuchKey(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey
+}
+
+// backupCorruptManifest copies the photos json file aside so that a
+// fresh manifest can be written in its place.
+func (o S3Options) backupCorruptManifest(ctx context.Context) error {
+	sess, err := o.session()
+	if err != nil {
+		return err
+	}
+	svc := s3.New(sess)
+	backupKey := fmt.Sprintf("%s.corrupt.%d", o.jsonKey(), time.Now().Unix())
+	_, err = svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(o.Bucket),
+		Key:        aws.String(backupKey),
+		CopySource: aws.String(fmt.Sprintf("%s/%s", o.Bucket, url.PathEscape(o.jsonKey()))),
+	})
+	if err != nil {
+		return fmt.Errorf("error backing up corrupt %s to %s: %w", o.jsonKey(), backupKey, err)
+	}
+	return nil
+}
+
+// isCorruptJSON reports whether err came from parsing malformed json
+func isCorruptJSON(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+// KeyData is the data available to S3Options.KeyTemplate
+type KeyData struct {
+	Prefix      string    // PhotosPrefix
+	ID          string    // Google Photos ID
+	Filename    string    // original filename
+	Ext         string    // extension of the filename, including the leading dot
+	Type        MediaType // PHOTO or VIDEO
+	CameraMake  string
+	CameraModel string
+	Width       int
+	Height      int
+	CreateTime  time.Time // zero if Google didn't provide one
+	Year        string    // four digit year of the create time, `unknown` if missing
+	Month       string    // two digit month of the create time, `unknown` if missing
+	Day         string    // two digit day of the create time, `unknown` if missing
+}
+
+// keyTemplate parses KeyTemplate, and checks that it only uses KeyData fields
+func (o S3Options) keyTemplate() (*template.Template, error) {
+	tmpl, err := template.New("key").Parse(o.KeyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key template: %w", err)
+	}
+	if err := tmpl.Execute(io.Discard, KeyData{}); err != nil {
+		return nil, fmt.Errorf("invalid key template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// templateKey renders the key template for the item. Like the UseFilename
+// keys, it only depends on the item, so the same photo gets the same key
+// in every run.
+func (o S3Options) templateKey(tmpl *template.Template, item GooglePhotosPickedItem) string {
+	m := item.Media.Metadata
+	data := KeyData{
+		Prefix:      o.PhotosPrefix,
+		ID:          sanitizeFilename(item.ID),
+		Filename:    o.sanitize(o.filename(item)),
+		Ext:         path.Ext(o.sanitize(o.filename(item))),
+		Type:        item.Type,
+		CameraMake:  sanitizeFilename(m.CameraMake),
+		CameraModel: sanitizeFilename(m.CameraModel),
+		Width:       m.Width,
+		Height:      m.Height,
+		CreateTime:  createTime(item),
+		Year:        "unknown",
+		Month:       "unknown",
+		Day:         "unknown",
+	}
+	if !data.CreateTime.IsZero() {
+		data.Year = data.CreateTime.Format("2006")
+		data.Month = data.CreateTime.Format("01")
+		data.Day = data.CreateTime.Format("02")
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		// the template was checked by keyTemplate, so fall back to the ID
+		return joinKey(o.PhotosPrefix, item.ID)
+	}
+	key := joinKey(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, b.String()))
+	if !strings.Contains(key, data.ID) {
+		key = withIDSuffix(key, item.ID)
+	}
+	return key
+}
+
+// objectMetadata returns the S3 user metadata for an item. Empty fields are
+// left out, and values are made ASCII since S3 only allows ASCII in headers.
+func objectMetadata(item GooglePhotosPickedItem) map[string]string {
+	m := item.Media.Metadata
+	fields := map[string]string{
+		"filename":     item.Media.Filename,
+		"create-time":  item.CreateTime,
+		"camera-make":  m.CameraMake,
+		"camera-model": m.CameraModel,
+	}
+	if m.Width != 0 && m.Height != 0 {
+		fields["width"] = strconv.Itoa(m.Width)
+		fields["height"] = strconv.Itoa(m.Height)
+	}
+	metadata := map[string]string{}
+	for k, v := range fields {
+		if v = asciiValue(v); v != "" {
+			metadata[k] = v
+		}
+	}
+	return metadata
+}
+
+// asciiValue replaces the non-ASCII and control characters in a metadata
+// value with `_`.
+func asciiValue(v string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, v))
+}
+
+// joinKey joins parts of an s3 key with `/`, dropping leading, trailing
+// and repeated slashes so prefixes with or without a trailing slash, or
+// empty ones, give the same clean key, like `photos/abc`.
+func joinKey(parts ...string) string {
+	var segments []string
+	for _, part := range parts {
+		for _, segment := range strings.Split(part, "/") {
+			if segment != "" {
+				segments = append(segments, segment)
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// jsonKey returns the normalized key of the photos json
+func (o S3Options) jsonKey() string {
+	return joinKey(o.PhotosJSONKey)
+}
+
+// sanitizeFilename makes a filename safe to use in an s3 key by replacing
+// path separators and control characters, so it can't create unexpected
+// key hierarchies. Runs of whitespace are collapsed to a single space and
+// trimmed, and a leading dot is replaced so names like `..` aren't special.
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Join(strings.Fields(name), " ")
+	if strings.HasPrefix(name, ".") {
+		name = "_" + name[1:]
+	}
+	return name
+}
+
+// sanitize makes a filename safe for a key with the SanitizeFilename hook,
+// or sanitizeFilename when it's not set.
+func (o S3Options) sanitize(name string) string {
+	if o.SanitizeFilename != nil {
+		return o.SanitizeFilename(name)
+	}
+	return sanitizeFilename(name)
+}
+
+// withIDSuffix adds a short suffix derived from the id to the filename,
+// before its extension. The suffix is a hash of the whole id, since ids
+// tend to share their first characters.
+func withIDSuffix(name string, id string) string {
+	extension := path.Ext(name)
+	sum := sha256.Sum256([]byte(id))
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(name, extension), hex.EncodeToString(sum[:4]), extension)
 }
@@ -0,0 +1,321 @@
+package gphotos
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-memory S3 that supports the requests the package makes:
+// head bucket, and get, head, put with If-Match and If-None-Match, copy and
+// delete of objects in the bucket.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte      // object bodies by key
+	headers  map[string]http.Header // headers of the last put by key
+	readOnly bool                   // deny puts as if the credentials can't write
+	putOnly  bool                   // deny everything but puts, like upload-only credentials
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, S3Options) {
+	t.Helper()
+	f := &fakeS3{objects: map[string][]byte{}, headers: map[string]http.Header{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	opts := NewS3Options("bucket")
+	opts.Endpoint = server.URL
+	opts.ForcePathStyle = true
+	opts.Region = "us-east-1"
+	opts.AccessKeyID = "key"
+	opts.SecretAccessKey = "secret"
+	return f, opts
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.putOnly && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>denied</Message></Error>`)
+		return
+	}
+	if r.URL.Path == "/bucket" || r.URL.Path == "/bucket/" {
+		w.WriteHeader(http.StatusOK) // head bucket
+		return
+	}
+	key, inBucket := strings.CutPrefix(r.URL.Path, "/bucket/")
+	if !inBucket {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchBucket</Code><Message>not found</Message></Error>`)
+		return
+	}
+	data, exists := f.objects[key]
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+			}
+			return
+		}
+		w.Header().Set("ETag", etagOf(data))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodPut:
+		if f.readOnly {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>denied</Message></Error>`)
+			return
+		}
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			source, _ = url.PathUnescape(source)
+			copied := f.objects[strings.TrimPrefix(source, "bucket/")]
+			f.objects[key] = copied
+			fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>`, etagOf(copied))
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != etagOf(data)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = body
+		f.headers[key] = r.Header.Clone()
+		w.Header().Set("ETag", etagOf(body))
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCorruptManifestBackupCanBeReplaced(t *testing.T) {
+	f, opts := newFakeS3(t)
+	opts.BackupCorruptManifest = true
+	f.objects["photos.json"] = []byte("not json")
+
+	photos, etag, err := opts.PhotoJSONWithETag(context.Background())
+	if err != nil {
+		t.Fatalf("PhotoJSONWithETag: %v", err)
+	}
+	if len(photos) != 0 || etag == "" {
+		t.Fatalf("got %d photos and etag %q, want none and the corrupt file's etag", len(photos), etag)
+	}
+	backedUp := false
+	for key := range f.objects {
+		backedUp = backedUp || strings.HasPrefix(key, "photos.json.corrupt.")
+	}
+	if !backedUp {
+		t.Error("the corrupt photos.json wasn't backed up")
+	}
+	picked := []GooglePhotosPickedItem{{ID: "a"}}
+	if _, err := opts.SetPhotoJSONIfUnchanged(context.Background(), etag, picked); err != nil {
+		t.Fatalf("SetPhotoJSONIfUnchanged: %v", err)
+	}
+	if got := string(f.objects["photos.json"]); !strings.Contains(got, `"id":"a"`) {
+		t.Errorf("photos.json is %s, want the new photos", got)
+	}
+}
+
+func TestJoinKey(t *testing.T) {
+	tests := []struct {
+		parts []string
+		want  string
+	}{
+		{[]string{"photos", "abc"}, "photos/abc"},
+		{[]string{"photos/", "abc"}, "photos/abc"},
+		{[]string{"/photos//", "/abc"}, "photos/abc"},
+		{[]string{"", "abc"}, "abc"},
+		{[]string{"a/b/", "2024/06", "abc.jpg"}, "a/b/2024/06/abc.jpg"},
+		{[]string{"/photos.json"}, "photos.json"},
+	}
+	for _, tt := range tests {
+		if got := joinKey(tt.parts...); got != tt.want {
+			t.Errorf("joinKey(%q) = %s, want %s", tt.parts, got, tt.want)
+		}
+	}
+}
+
+func TestKeyPrefixSlashes(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"photos":  "photos/abc",
+		"photos/": "photos/abc",
+		"":        "abc",
+	} {
+		opts := NewS3Options("bucket")
+		opts.PhotosPrefix = prefix
+		if got := opts.key(pickedItem("abc", "a.jpg")); got != want {
+			t.Errorf("key with prefix %q = %s, want %s", prefix, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	f, opts := newFakeS3(t)
+	if err := opts.Validate(context.Background()); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if len(f.objects) != 0 {
+		t.Errorf("the preflight object wasn't deleted: %v", f.objects)
+	}
+
+	missing := opts
+	missing.Bucket = "missing"
+	if err := missing.Validate(context.Background()); err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Errorf("got error %v for a missing bucket", err)
+	}
+
+	f.putOnly = true
+	if err := opts.Validate(context.Background()); err != nil {
+		t.Errorf("got error %v with upload-only credentials", err)
+	}
+	if _, ok := f.objects["photos/.gphotos-preflight"]; !ok {
+		t.Error("the preflight object wasn't left behind when deleting was denied")
+	}
+	f.putOnly = false
+
+	f.readOnly = true
+	if err := opts.Validate(context.Background()); err == nil || !strings.Contains(err.Error(), "unable to write") {
+		t.Errorf("got error %v for a read-only bucket", err)
+	}
+}
+
+// mediaServer serves every path as a small photo
+func mediaServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("photo " + r.URL.Path))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestStorageClassOnlyForMedia(t *testing.T) {
+	f, opts := newFakeS3(t)
+	opts.StorageClass = "GLACIER"
+	opts.SSE = "AES256"
+	opts.WriteSidecar = true
+	item := pickedItem("a", "a.jpg")
+	item.Media.BaseURL = mediaServer(t).URL + "/a"
+
+	if err := tokenCredentials().UploadToS3Context(context.Background(), []GooglePhotosPickedItem{item}, opts); err != nil {
+		t.Fatalf("UploadToS3Context: %v", err)
+	}
+	for key, want := range map[string]string{
+		"photos/a":      "GLACIER",
+		"photos/a.json": "",
+		"photos.json":   "",
+	} {
+		h, ok := f.headers[key]
+		if !ok {
+			t.Errorf("%s wasn't written", key)
+			continue
+		}
+		if got := h.Get("X-Amz-Storage-Class"); got != want {
+			t.Errorf("%s has storage class %q, want %q", key, got, want)
+		}
+		if got := h.Get("X-Amz-Server-Side-Encryption"); got != "AES256" {
+			t.Errorf("%s has encryption %q, want AES256", key, got)
+		}
+	}
+	if _, err := opts.SetPhotoJSONIfUnchanged(context.Background(), etagOf(f.objects["photos.json"]), nil); err != nil {
+		t.Fatalf("SetPhotoJSONIfUnchanged: %v", err)
+	}
+	if got := f.headers["photos.json"].Get("X-Amz-Storage-Class"); got != "" {
+		t.Errorf("conditional photos.json write has storage class %q", got)
+	}
+}
+
+func TestSkippedPhotosKeepSHA256(t *testing.T) {
+	f, opts := newFakeS3(t)
+	opts.SkipExisting = true
+	f.objects["photos/a"] = []byte("stored earlier")
+	server := mediaServer(t)
+	existing := pickedItem("a", "a.jpg")
+	existing.Media.BaseURL = server.URL + "/a"
+	existing.SHA256 = "recorded"
+	added := pickedItem("b", "b.jpg")
+	added.Media.BaseURL = server.URL + "/b"
+
+	if err := tokenCredentials().UploadToS3Context(context.Background(), []GooglePhotosPickedItem{existing, added}, opts); err != nil {
+		t.Fatalf("UploadToS3Context: %v", err)
+	}
+	photos, err := opts.PhotoJSON()
+	if err != nil {
+		t.Fatalf("PhotoJSON: %v", err)
+	}
+	hashes := map[string]string{}
+	for _, p := range photos {
+		hashes[p.ID] = p.SHA256
+	}
+	if hashes["a"] != "recorded" {
+		t.Errorf("skipped photo has sha256 %q, want the recorded hash", hashes["a"])
+	}
+	if hashes["b"] == "" || hashes["b"] == "recorded" {
+		t.Errorf("uploaded photo has sha256 %q, want its own hash", hashes["b"])
+	}
+}
+
+func TestMinPixelsLeavesSmallPhotosOutOfManifest(t *testing.T) {
+	f, opts := newFakeS3(t)
+	opts.MinPixels = 1000
+	server := mediaServer(t)
+	sized := func(item GooglePhotosPickedItem, width, height int) GooglePhotosPickedItem {
+		item.Media.BaseURL = server.URL + "/" + item.ID
+		item.Media.Metadata.Width, item.Media.Metadata.Height = width, height
+		return item
+	}
+	video := pickedItem("video", "v.mp4")
+	video.Type = TypeVideo
+	photos := []GooglePhotosPickedItem{
+		sized(pickedItem("small", "s.jpg"), 10, 10),
+		sized(pickedItem("large", "l.jpg"), 100, 100),
+		sized(video, 10, 10),
+	}
+
+	results, err := tokenCredentials().UploadToS3Detailed(photos, opts)
+	if err != nil {
+		t.Fatalf("UploadToS3Detailed: %v", err)
+	}
+	for _, r := range results {
+		if want := r.Item.ID == "small"; r.TooSmall != want || r.Skipped != want {
+			t.Errorf("%s: skipped %t, too small %t, want %t", r.Item.ID, r.Skipped, r.TooSmall, want)
+		}
+	}
+	if _, ok := f.objects["photos/video"]; !ok {
+		t.Error("the small video wasn't uploaded")
+	}
+	manifest, err := opts.PhotoJSON()
+	if err != nil {
+		t.Fatalf("PhotoJSON: %v", err)
+	}
+	var ids []string
+	for _, p := range manifest {
+		ids = append(ids, p.ID)
+	}
+	if strings.Join(ids, ",") != "large,video" {
+		t.Errorf("photos json has %v, want the uploaded large and video", ids)
+	}
+}
@@ -0,0 +1,145 @@
+package gphotos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Storage is a destination that picked media can be uploaded to, such as
+// an S3 bucket or a directory.
+type Storage interface {
+	// Put stores the contents of r at key
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	// PutJSON stores v marshaled as json at key
+	PutJSON(ctx context.Context, key string, v any) error
+}
+
+// S3Storage is a Storage that writes to an S3 bucket.
+//
+// S3 environment variables _must_ be set, see UploadToS3.
+type S3Storage struct {
+	Bucket       string           // Required. s3 bucket to upload content.
+	Session      *session.Session // AWS session to use, a new session is created from the environment when nil
+	StorageClass string           // storage class for new media objects, such as `STANDARD_IA` or `GLACIER`. Json files use the bucket's default. Defaults to the bucket's default
+	SSE          string           // server-side encryption for new objects, `AES256` or `aws:kms`. Defaults to the bucket's default
+	SSEKMSKeyID  string           // KMS key to encrypt with when SSE is `aws:kms`. Defaults to the AWS managed key
+
+	PartSize          int64 // size of each part of multipart uploads, at least 5 MiB. Defaults to s3manager's 5 MiB
+	UploadConcurrency int   // number of parts of a single object uploaded at once. Defaults to s3manager's 5
+}
+
+func (s S3Storage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	return s.put(ctx, key, r, contentType, nil)
+}
+
+// put is like Put, also setting the object's user metadata when not nil
+func (s S3Storage) put(ctx context.Context, key string, r io.Reader, contentType string, metadata map[string]string) error {
+	sess, err := s.session()
+	if err != nil {
+		return err
+	}
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(key),
+		Body:        r,
+		ContentType: aws.String(contentType),
+	}
+	if s.StorageClass != "" {
+		input.StorageClass = aws.String(s.StorageClass)
+	}
+	if s.SSE != "" {
+		input.ServerSideEncryption = aws.String(s.SSE)
+	}
+	if s.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.SSEKMSKeyID)
+	}
+	if metadata != nil {
+		input.Metadata = aws.StringMap(metadata)
+	}
+	// a failed multipart upload is aborted, so no orphaned parts are left
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		if s.PartSize > 0 {
+			u.PartSize = max(s.PartSize, s3manager.MinUploadPartSize)
+		}
+		if s.UploadConcurrency > 0 {
+			u.Concurrency = s.UploadConcurrency
+		}
+		u.LeavePartsOnError = false
+	})
+	_, err = uploader.UploadWithContext(ctx, input)
+	return err
+}
+
+// Exists reports whether an object is already stored at key
+func (s S3Storage) Exists(ctx context.Context, key string) (bool, error) {
+	sess, err := s.session()
+	if err != nil {
+		return false, err
+	}
+	_, err = s3.New(sess).HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	var awsErr awserr.RequestFailure
+	if errors.As(err, &awsErr) && awsErr.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// session returns the storage's AWS session, or creates a new one
+func (s S3Storage) session() (*session.Session, error) {
+	if s.Session != nil {
+		return s.Session, nil
+	}
+	return session.NewSession()
+}
+
+// PutJSON stores v marshaled as json at key. Json files are read back on
+// later runs, so they use the bucket's default storage class rather than
+// StorageClass, which could make them unreadable without a restore.
+func (s S3Storage) PutJSON(ctx context.Context, key string, v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.StorageClass = ""
+	return s.Put(ctx, key, bytes.NewReader(buf), "application/json")
+}
+
+// Upload downloads each of the photos and stores it in store, keyed by its
+// Google Photos ID, then writes a json dump of all the photos info to
+// `photos.json`. Use UploadToS3 for more control over the S3 keys.
+func (c *Credentials) Upload(ctx context.Context, photos []GooglePhotosPickedItem, store Storage, opts DownloadOptions) error {
+	if _, err := c.TokenContext(ctx); err != nil {
+		return err
+	}
+	if err := opts.checkItems(len(photos)); err != nil {
+		return err
+	}
+	var total int64
+	for i, p := range photos {
+		n, err := c.downloadTo(ctx, store, p, p.ID, opts)
+		if err != nil {
+			return err
+		}
+		total += n
+		if err := opts.checkBytes(i+1, total); err != nil {
+			return err
+		}
+	}
+	return store.PutJSON(ctx, "photos.json", photos)
+}
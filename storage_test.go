@@ -0,0 +1,77 @@
+package gphotos
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// memStorage is a Storage that keeps objects in memory
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	types   map[string]string // content types by key
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: map[string][]byte{}, types: map[string]string{}}
+}
+
+func (m *memStorage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = data
+	m.types[key] = contentType
+	return nil
+}
+
+func (m *memStorage) PutJSON(ctx context.Context, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = data
+	m.types[key] = "application/json"
+	return nil
+}
+
+func TestUploadToStorage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("photo " + r.URL.Path))
+	}))
+	defer server.Close()
+	photos := []GooglePhotosPickedItem{pickedItem("a", "a.jpg"), pickedItem("b", "b.jpg")}
+	for i := range photos {
+		photos[i].Media.BaseURL = server.URL + "/" + photos[i].ID
+	}
+	store := newMemStorage()
+
+	if err := tokenCredentials().Upload(context.Background(), photos, store, DownloadOptions{}); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	for _, p := range photos {
+		if got := string(store.objects[p.ID]); got != "photo /"+p.ID {
+			t.Errorf("stored %q at %s", got, p.ID)
+		}
+		if store.types[p.ID] != "image/jpeg" {
+			t.Errorf("%s stored as %s, want image/jpeg", p.ID, store.types[p.ID])
+		}
+	}
+	var manifest []GooglePhotosPickedItem
+	if err := json.Unmarshal(store.objects["photos.json"], &manifest); err != nil {
+		t.Fatalf("photos.json: %v", err)
+	}
+	if len(manifest) != len(photos) {
+		t.Errorf("photos.json has %d photos, want %d", len(manifest), len(photos))
+	}
+}
@@ -0,0 +1,60 @@
+package gphotos
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteZip downloads each of the photos and streams them to w as a zip
+// archive, along with a `photos.json` manifest, without staging them on
+// disk. Entries are named by the photos' original filenames, with a short
+// suffix from the ID, see S3Options.UseFilename. Since a partly
+// written archive can't be recovered, it stops at the first failed photo.
+func (c *Credentials) WriteZip(ctx context.Context, photos []GooglePhotosPickedItem, w io.Writer, opts DownloadOptions) error {
+	if _, err := c.TokenContext(ctx); err != nil {
+		return err
+	}
+	archive := zip.NewWriter(w)
+	keys := S3Options{DownloadOptions: opts, UseFilename: true}.keys(photos)
+	for i, p := range photos {
+		if err := c.writeZipEntry(ctx, archive, p, strings.TrimPrefix(keys[i], "/"), opts); err != nil {
+			return fmt.Errorf("error adding %s to zip: %w", p.ID, err)
+		}
+	}
+
+	manifest, err := archive.Create("photos.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(manifest).Encode(photos); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// writeZipEntry downloads the item into a new entry of the archive
+func (c *Credentials) writeZipEntry(ctx context.Context, archive *zip.Writer, item GooglePhotosPickedItem, name string, opts DownloadOptions) error {
+	ctx, cancel := opts.itemContext(ctx)
+	defer cancel()
+	media, err := c.openMedia(ctx, item, opts)
+	if err != nil {
+		return err
+	}
+	defer media.Close()
+
+	// photos and videos are already compressed, so store them as-is
+	header := &zip.FileHeader{Name: name, Method: zip.Store}
+	if t := createTime(item); !t.IsZero() {
+		header.Modified = t
+	}
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, media)
+	return err
+}